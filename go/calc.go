@@ -0,0 +1,111 @@
+/*
+ *  Copyright 2023 The original authors
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+// Simple reference implementation of the One Billion Row Challenge:
+// bufio.Scanner and strconv, no tricks.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type stats struct {
+	min, max, sum float64
+	count         int64
+}
+
+func main() {
+	log.SetFlags(0)
+
+	f := os.Stdin
+	if len(os.Args) > 1 {
+		var err error
+		if f, err = os.Open(os.Args[1]); err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+	}
+
+	res := make(map[string]*stats)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		station, temp, ok := strings.Cut(sc.Text(), ";")
+		if !ok {
+			log.Fatalf("invalid row %q", sc.Text())
+		}
+		v, err := strconv.ParseFloat(temp, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s := res[station]
+		if s == nil {
+			res[station] = &stats{min: v, max: v, sum: v, count: 1}
+			continue
+		}
+		if v < s.min {
+			s.min = v
+		}
+		if v > s.max {
+			s.max = v
+		}
+		s.sum += v
+		s.count++
+	}
+	if err := sc.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	stations := make([]string, 0, len(res))
+	for station := range res {
+		stations = append(stations, station)
+	}
+	sort.Strings(stations)
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	w.WriteByte('{')
+	for i, station := range stations {
+		if i > 0 {
+			w.WriteString(", ")
+		}
+		s := res[station]
+		fmt.Fprintf(w, "%s=%.1f/%.1f/%.1f", station,
+			nonNegZero(s.min), roundJava(s.sum/float64(s.count)), nonNegZero(s.max))
+	}
+	w.WriteString("}\n")
+}
+
+// roundJava rounds to one decimal like java.lang.Math.round: half up
+// towards positive infinity. Plain %.1f would round half to even and could
+// print -0.0, diverging from the reference output.
+func roundJava(x float64) float64 {
+	return nonNegZero(math.Floor(x*10+0.5) / 10)
+}
+
+func nonNegZero(x float64) float64 {
+	if x == 0 {
+		return 0
+	}
+	return x
+}
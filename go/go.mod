@@ -0,0 +1,3 @@
+module onebrc-simple
+
+go 1.21
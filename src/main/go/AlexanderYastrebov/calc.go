@@ -0,0 +1,4070 @@
+/*
+ *  Copyright 2023 The original authors
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+// One Billion Row Challenge: aggregate min/mean/max temperature per weather
+// station from a `<station>;<temperature>` text file.
+//
+// Temperatures match `^-?[0-9]{1,2}[.][0-9]$` and are aggregated as int64
+// tenths throughout; floating point only appears at output time.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"math/bits"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+type options struct {
+	workers        int
+	noMmap         bool
+	prefetch       bool
+	format         string
+	noSort         bool
+	normalize      bool
+	caseFold       bool
+	assumeASCII    bool
+	unicodeMinus   bool
+	quotedIds      bool
+	timestamps     bool
+	scientific     bool
+	nullValue      string
+	signToken      string
+	stripSuffix    bool
+	limit          int64
+	emitRows       int64
+	javaCompat     bool
+	checksum       bool
+	orderFile      string
+	omitUnlisted   bool
+	excludeFile    string
+	minmaxRows     bool
+	fixed          string
+	partitionBy    string
+	partitionDir   string
+	hashStats      bool
+	repeat         int
+	outFile        string
+	dedupe         bool
+	distinctValues bool
+	reservoir      int
+	reservoirOut   string
+	reservoirSeed  int64
+	autoSep        string
+	weighted       bool
+	strict         bool
+	noGC           bool
+	only           string
+	appendFile     string
+	warnMerges     bool
+	swarIds        bool
+	order          string
+	// extraFields is the number of trailing row fields beyond the
+	// temperature, declared by a -use-header header and ignored by the
+	// parser.
+	extraFields     int
+	meanMode        string
+	compact         bool
+	withCount       bool
+	reportSimilar   bool
+	startAfter      string
+	useHeader       bool
+	outputEncoding  string
+	debug           bool
+	sortedInput     bool
+	stream          bool
+	rawTenths       bool
+	offsetTenths    int64
+	quantize        int64
+	flushInterval   time.Duration
+	spillDir        string
+	spillLimit      int
+	mmapThreshold   int
+	maxStations     int
+	columns         string
+	fill            string
+	glob            string
+	runReport       string
+	validateUTF8    bool
+	skipInvalidUTF8 bool
+	extSort         int
+	tee             string
+	truncateNames   int
+	explain         int
+	estimate        bool
+	generate        string
+	baseline        string
+	omitUnbaselined bool
+	anomalyMinmax   bool
+	verbose         bool
+	groupPrefix     string
+	alsoDetail      bool
+	compare         string
+	writeGolden     string
+	merge           bool
+	saveState       string
+	loadState       string
+}
+
+// applyEnvOverrides reads settings from the environment for deployments
+// where passing flags is awkward, e.g. containers. The precedence is
+// flag > environment > built-in default: an explicitly set flag wins and
+// an unset variable leaves the default in place.
+func applyEnvOverrides(flagSet func(name string) bool, getenv func(string) string) {
+	if v := getenv("ONEBRC_WORKERS"); v != "" && !flagSet("workers") {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("invalid ONEBRC_WORKERS %q", v)
+		}
+		opt.workers = n
+	}
+	if v := getenv("ONEBRC_NO_MMAP"); v != "" && !flagSet("no-mmap") {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid ONEBRC_NO_MMAP %q", v)
+		}
+		opt.noMmap = b
+	}
+}
+
+func defaultOptions() options {
+	return options{
+		workers:       runtime.NumCPU(),
+		format:        "brace",
+		order:         "station-first",
+		meanMode:      "round",
+		maxStations:   1 << 21,
+		mmapThreshold: 64 << 10,
+		reservoirSeed: 1,
+		fill:          "NaN",
+		assumeASCII:   true,
+	}
+}
+
+var opt = defaultOptions()
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("calc: ")
+
+	flag.IntVar(&opt.workers, "workers", opt.workers, "number of parallel chunks")
+	flag.BoolVar(&opt.noMmap, "no-mmap", opt.noMmap, "read the input instead of memory-mapping it")
+	flag.IntVar(&opt.mmapThreshold, "mmap-threshold", opt.mmapThreshold, "read files smaller than this many bytes instead of memory-mapping them; mmap setup costs more than a small read")
+	flag.BoolVar(&opt.prefetch, "prefetch", opt.prefetch, "fault mapped pages in ahead of the workers to overlap IO with parsing")
+	flag.StringVar(&opt.format, "format", opt.format, "output format, see -list-formats")
+	listFormats := flag.Bool("list-formats", false, "print the supported output formats and exit")
+	selftest := flag.Bool("selftest", false, "aggregate a synthetic in-memory dataset, verify the result against analytically known values and exit")
+	flag.BoolVar(&opt.noSort, "no-sort", opt.noSort, "do not sort stations in the output")
+	flag.BoolVar(&opt.normalize, "normalize", opt.normalize, "trim surrounding whitespace from station ids; ids that only differ in surrounding whitespace aggregate together and the trimmed form is the display key")
+	flag.BoolVar(&opt.caseFold, "ci", opt.caseFold, "case-insensitive station ids: ASCII letters are lowercased before recording and the lowercased form is the display key; non-ASCII letters are only folded with -assume-ascii=false")
+	flag.BoolVar(&opt.unicodeMinus, "unicode-minus", opt.unicodeMinus, "also accept the Unicode minus sign U+2212 before temperatures; all rows take the scalar parser, so this costs throughput")
+	flag.BoolVar(&opt.assumeASCII, "assume-ascii", opt.assumeASCII, "treat station ids byte-wise in name operations like -ci and -truncate-names; disable for Unicode-correct folding and rune-counted truncation at some cost")
+	flag.BoolVar(&opt.quotedIds, "quoted-ids", opt.quotedIds, "station ids may be double-quoted to contain ';', with inner quotes doubled; slower")
+	flag.BoolVar(&opt.timestamps, "timestamps", opt.timestamps, "rows carry a third ';'-separated timestamp field; record and print the timestamps at which each station's min and max occurred")
+	flag.BoolVar(&opt.scientific, "scientific", opt.scientific, "parse temperatures with strconv, accepting scientific notation like 1.2e1; much slower than the fast path")
+	flag.StringVar(&opt.nullValue, "null-value", opt.nullValue, "treat rows with this exact temperature field as missing readings and skip them; skipped rows do not contribute to count")
+	flag.BoolVar(&opt.stripSuffix, "strip-suffix", opt.stripSuffix, "ignore trailing unit bytes after the temperature, e.g. 'station;12.3C' or 'station;12.3°C'")
+	flag.StringVar(&opt.signToken, "sign-token", opt.signToken, "rows carry a ';'-separated sign field before the temperature magnitude, e.g. 'station;-;12.3'; a field equal to this token negates the value, any other field leaves it positive")
+	flag.Int64Var(&opt.limit, "limit", opt.limit, "process at most this many rows, 0 means all")
+	flag.Int64Var(&opt.emitRows, "emit-interval", opt.emitRows, "in streaming mode, emit a snapshot of the aggregation every N rows")
+	flag.DurationVar(&opt.flushInterval, "flush-interval", opt.flushInterval, "with streaming input, also emit a partial result snapshot at most this often, so idle periods still show current state")
+	flag.BoolVar(&opt.javaCompat, "java-compat", opt.javaCompat, "pin the output to the reference Java layout: sorted brace format, overriding -format and -no-sort")
+	flag.StringVar(&opt.orderFile, "order-file", opt.orderFile, "emit stations in the order listed in this file, one id per line; stations not listed are appended sorted")
+	flag.BoolVar(&opt.omitUnlisted, "omit-unlisted", opt.omitUnlisted, "with -order-file, drop stations that are not listed instead of appending them")
+	flag.StringVar(&opt.excludeFile, "exclude-file", opt.excludeFile, "drop stations listed in this file, one id per line")
+	flag.BoolVar(&opt.minmaxRows, "minmax-rows", opt.minmaxRows, "report the 0-based row index where each station's min and max first occurred")
+	flag.StringVar(&opt.fixed, "fixed", opt.fixed, "parse fixed-width records instead of `station;temperature` lines, e.g. id=32,temp=6")
+	flag.StringVar(&opt.partitionBy, "partition-by", opt.partitionBy, "partitioning key for -partition-dir: firstchar (first character of the id) or segment (id up to the first /)")
+	flag.StringVar(&opt.partitionDir, "partition-dir", opt.partitionDir, "write results into one file per partition in this directory instead of a single output")
+	flag.BoolVar(&opt.hashStats, "hash-stats", opt.hashStats, "report the bucket chain length distribution of the chunk hash tables on stderr")
+	flag.IntVar(&opt.repeat, "repeat", opt.repeat, "process the input this many times, reporting per-run durations on stderr")
+	flag.StringVar(&opt.outFile, "o", opt.outFile, "write the output to this file instead of stdout")
+	flag.BoolVar(&opt.dedupe, "dedupe", opt.dedupe, "accumulate each distinct (station, temperature) pair only once; count becomes the number of distinct values seen")
+	flag.BoolVar(&opt.distinctValues, "distinct-values", opt.distinctValues, "report the number of distinct temperature values per station as an extra output field")
+	flag.IntVar(&opt.reservoir, "reservoir", opt.reservoir, "keep a uniform sample of up to K readings per station for distribution analysis")
+	flag.StringVar(&opt.reservoirOut, "reservoir-out", opt.reservoirOut, "with -reservoir, write one 'station;reading;...' line per station to this file")
+	flag.Int64Var(&opt.reservoirSeed, "reservoir-seed", opt.reservoirSeed, "seed for the -reservoir sampling")
+	flag.StringVar(&opt.autoSep, "auto-sep", opt.autoSep, "accept any of these bytes as the id separator, first one found per row wins, e.g. ';,'; slower")
+	flag.BoolVar(&opt.weighted, "weighted", opt.weighted, "rows carry a third ';'-separated sample count, e.g. 'station;12.3;40'; the mean weights each temperature by it while min/max use the temperature directly")
+	flag.BoolVar(&opt.strict, "strict", opt.strict, "validate every row against the `station;temperature` grammar and abort on the first violation; safe for untrusted data but much slower than the fast path")
+	flag.BoolVar(&opt.noGC, "no-gc", opt.noGC, "disable the garbage collector for the run; the single-shot process exits before collection would pay off, at the cost of unbounded memory growth")
+	flag.StringVar(&opt.only, "only", opt.only, "project the output to a single statistic: min, mean, max or count")
+	flag.StringVar(&opt.columns, "columns", opt.columns, "choose and order the csv/table/ndjson fields, e.g. 'station,max,min,count'")
+	flag.StringVar(&opt.fill, "fill", opt.fill, "with -format dense, the value emitted for stations listed in -order-file but absent from the data")
+	flag.StringVar(&opt.appendFile, "append", opt.appendFile, "merge the result into this json result file and rewrite it in place of other output")
+	flag.BoolVar(&opt.warnMerges, "warn-merges", opt.warnMerges, "warn on stderr when distinct raw ids collapse into one display key under -normalize or -ci")
+	flag.BoolVar(&opt.swarIds, "swar-ids", opt.swarIds, "scan and hash station ids 8 bytes at a time; faster on long ids")
+	flag.BoolVar(&opt.sortedInput, "sorted-input", opt.sortedInput, "assume rows are sorted by station id and aggregate contiguous runs without hashing; unsorted input still aggregates correctly but slower than the default path")
+	flag.BoolVar(&opt.stream, "stream", opt.stream, "with -sorted-input, print each station the moment its run ends instead of buffering the whole result; single-threaded")
+	flag.Int64Var(&opt.offsetTenths, "offset-tenths", opt.offsetTenths, "add this many tenths of a degree to every reading before aggregation, correcting a known sensor bias; may be negative")
+	flag.Int64Var(&opt.quantize, "quantize", opt.quantize, "round each reading to the nearest multiple of this many tenths before aggregation, e.g. 5 for half degrees; min, max and sum reflect the snapped values, count is unaffected")
+	flag.BoolVar(&opt.rawTenths, "raw-tenths", opt.rawTenths, "with -format sqlite, json, protobuf or parquet, store the exact integer tenths (min, max, sum) instead of rounded floats; json shards written this way re-merge losslessly")
+	flag.StringVar(&opt.startAfter, "start-after", opt.startAfter, "skip everything up to and including the first line exactly equal to this marker, e.g. a file preamble ending in '=== DATA ==='")
+	flag.BoolVar(&opt.useHeader, "use-header", opt.useHeader, "the first line is a '#'-prefixed schema header like '#station;temperature'; it configures the field order and extra columns, only the temperature aggregates")
+	flag.StringVar(&opt.outputEncoding, "output-encoding", opt.outputEncoding, "transcode the output for non-UTF-8 consumers; supported: latin1 (unmappable characters become '?')")
+	flag.BoolVar(&opt.reportSimilar, "report-similar", opt.reportSimilar, "report station ids on stderr that differ only by case, surrounding whitespace or trailing punctuation, as likely data-entry duplicates; they are not merged")
+	flag.BoolVar(&opt.withCount, "with-count", opt.withCount, "append /count to each station in the brace format; off by default for spec compliance")
+	flag.BoolVar(&opt.compact, "compact", opt.compact, "separate brace format entries with ',' instead of ', '; smallest output together with -no-sort")
+	flag.StringVar(&opt.meanMode, "mean-mode", opt.meanMode, "mean precision: round (the challenge's single rounded decimal), exact (full float precision) or highprec (6 decimals)")
+	flag.StringVar(&opt.order, "order", opt.order, "field order per row: station-first (the default `station;temperature`) or temp-first (`temperature;station`)")
+	flag.BoolVar(&opt.checksum, "checksum", opt.checksum, "print an FNV-1a hash of the output instead of the output itself; identical hashes mean identical aggregation when the output is sorted")
+	flag.BoolVar(&opt.verbose, "verbose", opt.verbose, "log resolved configuration and environment to stderr")
+	flag.BoolVar(&opt.debug, "debug", opt.debug, "enable internal consistency assertions that abort on violation; slower")
+	flag.StringVar(&opt.groupPrefix, "group-by-prefix", opt.groupPrefix, "roll stations up by their id prefix before the first occurrence of this separator, e.g. '/' for US/CA/SF")
+	flag.BoolVar(&opt.alsoDetail, "also-detail", opt.alsoDetail, "with -group-by-prefix, print the per-station result after the rolled-up one")
+	flag.StringVar(&opt.compare, "compare", opt.compare, "compare the output against the given file and fail on mismatch")
+	flag.StringVar(&opt.writeGolden, "write-golden", opt.writeGolden, "also write the output to the given file, for later use with -compare; keep the default sorted format so diffs are stable")
+	flag.BoolVar(&opt.merge, "merge", opt.merge, "arguments are json result files to merge instead of a measurements file")
+	flag.StringVar(&opt.glob, "glob", opt.glob, "aggregate over all files matching this pattern in modification time order, e.g. 'measurements.*' for rotated logs")
+	flag.StringVar(&opt.runReport, "run-report", opt.runReport, "write machine-readable run metadata (chunk layout, row counts, timings) to this json file")
+	flag.StringVar(&opt.saveState, "save-state", opt.saveState, "write the aggregation to the given file as a binary checkpoint")
+	flag.StringVar(&opt.baseline, "baseline", opt.baseline, "subtract per-station baseline means loaded from this json file (station to degrees) from the output means, reporting anomalies instead of absolutes")
+	flag.BoolVar(&opt.omitUnbaselined, "omit-unbaselined", opt.omitUnbaselined, "with -baseline, drop stations that have no baseline instead of reporting them as-is")
+	flag.BoolVar(&opt.anomalyMinmax, "anomaly-minmax", opt.anomalyMinmax, "with -baseline, shift min and max by the baseline as well")
+	flag.StringVar(&opt.generate, "generate", opt.generate, "write a synthetic measurements file to the output instead of aggregating, e.g. rows=1000000,stations=413,seed=1")
+	flag.IntVar(&opt.truncateNames, "truncate-names", opt.truncateNames, "truncate station ids to at most this many bytes on a UTF-8 rune boundary; distinct stations that collide after truncation aggregate together")
+	flag.IntVar(&opt.explain, "explain", opt.explain, "print how the parser reads the first N rows to stderr before the run, to verify an unfamiliar dataset")
+	flag.BoolVar(&opt.estimate, "estimate", opt.estimate, "sample the head of the file and print projected rows, stations, runtime and memory instead of running; file input only")
+	flag.StringVar(&opt.tee, "tee", opt.tee, "additionally print the result to stderr in this format, e.g. a human-readable table next to machine output on -o")
+	flag.IntVar(&opt.extSort, "ext-sort", opt.extSort, "sort the output station ids via an external merge sort in runs of this many ids when there are more, bounding sort memory at extreme cardinality; 0 keeps the in-memory sort")
+	flag.BoolVar(&opt.validateUTF8, "validate-utf8", opt.validateUTF8, "check every station id is valid UTF-8, reporting each invalid one with the offset of its first bad byte")
+	flag.BoolVar(&opt.skipInvalidUTF8, "skip-invalid-utf8", opt.skipInvalidUTF8, "with -validate-utf8, drop invalid station ids from the result")
+	flag.StringVar(&opt.spillDir, "spill-dir", opt.spillDir, "bound streaming memory: spill the least-recently-updated stations' partial aggregates to a file in this directory once -spill-limit stations are resident, re-merging them at the end; applies when reading from a stream")
+	flag.IntVar(&opt.spillLimit, "spill-limit", opt.spillLimit, "with -spill-dir, the maximum number of stations kept in memory")
+	flag.IntVar(&opt.maxStations, "max-stations", opt.maxStations, "fail if the distinct station count exceeds this cap")
+	flag.StringVar(&opt.loadState, "load-state", opt.loadState, "seed the aggregation from a checkpoint written by -save-state before merging new data")
+	flag.Parse()
+
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	applyEnvOverrides(func(name string) bool { return explicit[name] }, os.Getenv)
+
+	if *listFormats {
+		fmt.Println(strings.Join(formatNames(), "\n"))
+		return
+	}
+	if *selftest {
+		if err := selfTest(); err != nil {
+			fmt.Println("FAIL")
+			log.Fatal(err)
+		}
+		fmt.Println("PASS")
+		return
+	}
+	if _, ok := formats[opt.format]; !ok {
+		log.Fatalf("unknown format %q, supported formats: %s", opt.format, strings.Join(formatNames(), ", "))
+	}
+	if _, ok := formats[opt.tee]; opt.tee != "" && !ok {
+		log.Fatalf("unknown -tee format %q, supported formats: %s", opt.tee, strings.Join(formatNames(), ", "))
+	}
+	switch opt.only {
+	case "", "min", "mean", "max", "count":
+	default:
+		log.Fatalf("unknown -only statistic %q, supported: min, mean, max, count", opt.only)
+	}
+	switch opt.order {
+	case "station-first", "temp-first":
+	default:
+		log.Fatalf("unknown -order %q, supported: station-first, temp-first", opt.order)
+	}
+	switch opt.meanMode {
+	case "round", "exact", "highprec":
+	default:
+		log.Fatalf("unknown -mean-mode %q, supported: round, exact, highprec", opt.meanMode)
+	}
+	switch opt.outputEncoding {
+	case "", "utf8", "latin1":
+	default:
+		log.Fatalf("unknown -output-encoding %q, supported: utf8, latin1", opt.outputEncoding)
+	}
+	if opt.stream && !opt.sortedInput {
+		log.Fatalf("-stream requires -sorted-input")
+	}
+	if opt.strict && opt.order == "temp-first" {
+		log.Fatalf("-strict does not support -order temp-first; its validator only knows station-first rows")
+	}
+	if opt.workers <= 0 {
+		log.Fatalf("-workers must be positive, got %d", opt.workers)
+	}
+	if opt.columns != "" {
+		outputColumns = parseColumns(opt.columns)
+	}
+
+	if opt.noGC {
+		debug.SetGCPercent(-1)
+	}
+	if opt.excludeFile != "" {
+		excludeSet = loadExclude(opt.excludeFile)
+	}
+	if opt.autoSep != "" {
+		sepTable = buildSepTable(opt.autoSep)
+	}
+	if opt.baseline != "" {
+		baselineMeans = loadBaseline(opt.baseline)
+	}
+
+	if opt.merge {
+		mergeResultFiles(flag.Args(), os.Stdout)
+		return
+	}
+
+	input := "measurements.txt"
+	if flag.NArg() > 0 {
+		input = flag.Arg(0)
+	}
+	output := io.Writer(os.Stdout)
+	if opt.outFile != "" {
+		f, err := os.Create(opt.outFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		output = f
+	}
+	if opt.generate != "" {
+		generateMeasurements(opt.generate, output)
+		return
+	}
+	if opt.glob != "" {
+		processGlob(opt.glob, output)
+		return
+	}
+	processFile(input, output)
+}
+
+// processGlob aggregates over every file matching the pattern, oldest
+// first by modification time, so a ring of rotated logs like
+// measurements.1, measurements.2 merges in chronological order. Files
+// may rotate away between the glob expansion and the read; those are
+// skipped with a note rather than failing the whole run.
+func processGlob(pattern string, output io.Writer) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(paths) == 0 {
+		log.Fatalf("-glob %q matched no files", pattern)
+	}
+	type entry struct {
+		path  string
+		mtime time.Time
+	}
+	var entries []entry
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			log.Printf("skipping %s: %v", path, err)
+			continue
+		}
+		entries = append(entries, entry{path, fi.ModTime()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].mtime.Before(entries[j].mtime) })
+
+	res := measurements{}
+	for _, e := range entries {
+		data, err := os.ReadFile(e.path)
+		if err != nil {
+			log.Printf("skipping %s: %v", e.path, err)
+			continue
+		}
+		if len(data) == 0 {
+			continue
+		}
+		verbosef("glob input %s: %d bytes", e.path, len(data))
+		res.merge(process(data, opt.workers))
+	}
+	finish(res, output)
+}
+
+// generateMeasurements writes a synthetic measurements file per the
+// -generate spec, making benchmarks reproducible without the repository's
+// create_measurements.sh. Station i draws uniformly from a fixed
+// per-station range, rows follow the exact `station;temperature` grammar
+// the parser expects, and the same seed yields the same file.
+func generateMeasurements(spec string, output io.Writer) {
+	rows, stations, seed := parseGenerateSpec(spec)
+	rng := rand.New(rand.NewSource(seed))
+
+	w := bufio.NewWriter(output)
+	defer w.Flush()
+	for r := int64(0); r < rows; r++ {
+		i := rng.Intn(stations)
+		// Center station i somewhere in [-40.0, 59.9] with ±20.0 spread,
+		// clamped to the valid domain.
+		center := i*100/stations*10 - 400
+		v := center + rng.Intn(401) - 200
+		if v < -999 {
+			v = -999
+		}
+		if v > 999 {
+			v = 999
+		}
+		sign := ""
+		if v < 0 {
+			sign = "-"
+		}
+		fmt.Fprintf(w, "station-%03d;%s%d.%d\n", i, sign, abs(v)/10, abs(v)%10)
+	}
+}
+
+// parseGenerateSpec parses the -generate value, e.g.
+// "rows=1000000,stations=413,seed=1".
+func parseGenerateSpec(spec string) (rows int64, stations int, seed int64) {
+	stations = 413
+	seed = 1
+	for _, field := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(field, "=")
+		n, err := strconv.ParseInt(value, 10, 64)
+		if !ok || err != nil {
+			log.Fatalf("invalid -generate field %q", field)
+		}
+		switch name {
+		case "rows":
+			rows = n
+		case "stations":
+			stations = int(n)
+		case "seed":
+			seed = n
+		default:
+			log.Fatalf("invalid -generate field %q", field)
+		}
+	}
+	if rows <= 0 || stations <= 0 {
+		log.Fatalf("-generate must specify positive rows and stations, e.g. rows=1000000,stations=413")
+	}
+	return rows, stations, seed
+}
+
+// selfTest aggregates a generated dataset whose per-station min, mean
+// and max are known in closed form and compares the brace output against
+// them. It exercises the real chunking and merge path, so a PASS on a
+// new machine means the binary, not just the test suite, works there.
+func selfTest() error {
+	const stations, perStation = 10, 101
+	var input bytes.Buffer
+	// Round-robin over stations so every chunk sees all of them.
+	for j := 0; j < perStation; j++ {
+		for i := 0; i < stations; i++ {
+			// Station i covers tenths [7i-50, 7i+50]: min and max are the
+			// endpoints and the mean is exactly the midpoint 7i.
+			v := 7*i - 50 + j
+			sign := ""
+			if v < 0 {
+				sign = "-"
+			}
+			fmt.Fprintf(&input, "S%02d;%s%d.%d\n", i, sign, abs(v)/10, abs(v)%10)
+		}
+	}
+
+	var want strings.Builder
+	want.WriteString("{")
+	for i := 0; i < stations; i++ {
+		if i > 0 {
+			want.WriteString(", ")
+		}
+		fmt.Fprintf(&want, "S%02d=%.1f/%.1f/%.1f", i,
+			float64(7*i-50)/10, float64(7*i)/10, float64(7*i+50)/10)
+	}
+	want.WriteString("}\n")
+
+	var got bytes.Buffer
+	printResult(process(input.Bytes(), opt.workers), &got)
+	if got.String() != want.String() {
+		return fmt.Errorf("selftest: %d rows over %d stations aggregated to\n\t%s\nwant\n\t%s",
+			stations*perStation, stations, got.String(), want.String())
+	}
+	return nil
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// estimateRun samples up to the first MB of the file and prints
+// projections for a full run without performing it: row count from the
+// average sampled row length, distinct stations from the sample,
+// runtime from actually aggregating the sample with the configured
+// workers, and peak memory from the projected cardinality. The numbers
+// are there to pick -workers and memory flags before committing to a
+// multi-hundred-gigabyte pass, not to be exact.
+func estimateRun(path string, output io.Writer) {
+	f, err := os.Open(normalizePath(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	size := fi.Size()
+
+	head := make([]byte, 1<<20)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		log.Fatal(err)
+	}
+	// Partial trailing rows would skew the average row length.
+	head = head[:n]
+	if nl := bytes.LastIndexByte(head, '\n'); nl != -1 {
+		head = head[:nl+1]
+	} else {
+		head = head[:0]
+	}
+	if len(head) == 0 {
+		log.Fatalf("-estimate: no complete row in the first %d bytes of %s", n, path)
+	}
+
+	rows := int64(bytes.Count(head, []byte{'\n'}))
+	distinct := map[string]struct{}{}
+	for i := 0; i < len(head); {
+		nl := bytes.IndexByte(head[i:], '\n')
+		row := head[i : i+nl]
+		i += nl + 1
+		if sep := bytes.IndexByte(row, ';'); sep != -1 {
+			distinct[string(row[:sep])] = struct{}{}
+		}
+	}
+
+	avgRow := float64(len(head)) / float64(rows)
+	estRows := int64(float64(size) / avgRow)
+
+	// If the sample was still discovering stations at a high rate the
+	// set is larger than what we saw; scale linearly with the row count
+	// then. Otherwise assume the sample saturated it, which holds for
+	// the usual few hundred stations recurring across a billion rows.
+	estStations := int64(len(distinct))
+	if estStations > rows/2 && rows > 0 {
+		estStations = estStations * estRows / rows
+	}
+
+	// Calibrate throughput by aggregating the sample for real.
+	begin := time.Now()
+	process(head, opt.workers)
+	elapsed := time.Since(begin)
+	if elapsed <= 0 {
+		elapsed = time.Microsecond
+	}
+	throughput := float64(len(head)) / elapsed.Seconds()
+	projected := time.Duration(float64(size) / throughput * float64(time.Second))
+
+	// Per-chunk tables dominate the heap: roughly id plus measurement
+	// per station per worker. The input itself only counts when it is
+	// read into memory instead of mmapped.
+	memBytes := int64(opt.workers) * estStations * 128
+	if opt.noMmap || size < int64(opt.mmapThreshold) {
+		memBytes += size
+	}
+
+	w := bufio.NewWriter(output)
+	defer w.Flush()
+	fmt.Fprintf(w, "input: %d bytes\n", size)
+	fmt.Fprintf(w, "sampled: %d rows in %d bytes, %d distinct stations\n", rows, len(head), len(distinct))
+	fmt.Fprintf(w, "estimated rows: %d (avg row %.1f bytes)\n", estRows, avgRow)
+	fmt.Fprintf(w, "estimated distinct stations: %d\n", estStations)
+	fmt.Fprintf(w, "projected runtime: %s (%d workers, %.0f MB/s sampled)\n", projected.Round(time.Millisecond), opt.workers, throughput/1e6)
+	fmt.Fprintf(w, "projected peak memory: %d MB\n", (memBytes+1<<20-1)>>20)
+}
+
+func processFile(path string, output io.Writer) {
+	if path == "-" {
+		processStream(maybeGzip(os.Stdin), output)
+		return
+	}
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		processURL(path, output)
+		return
+	}
+
+	if opt.estimate {
+		estimateRun(path, output)
+		return
+	}
+
+	f, err := os.Open(normalizePath(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	size := int(fi.Size())
+	if size == 0 {
+		finish(measurements{}, output)
+		return
+	}
+
+	var data []byte
+	if !opt.noMmap && size >= opt.mmapThreshold {
+		region, merr := mmapPadded(int(f.Fd()), size)
+		if merr == nil {
+			defer munmap(region)
+			data = region[:size]
+		}
+	}
+	mmapped := data != nil
+	if data == nil {
+		data, err = io.ReadAll(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	verbosef("input %s: %d bytes, mmap=%v", path, size, mmapped)
+
+	if opt.prefetch && mmapped {
+		stop := prefetchPages(data)
+		defer stop()
+	}
+
+	if opt.stream {
+		streamSorted(data, output)
+		return
+	}
+
+	// -repeat keeps the mapping in place and processes the same data N
+	// times: the early runs warm caches, the duration spread shows the
+	// variance. Only the last result is printed.
+	var res measurements
+	if opt.repeat <= 1 {
+		res = process(data, opt.workers)
+	} else {
+		durations := make([]time.Duration, 0, opt.repeat)
+		for i := 0; i < opt.repeat; i++ {
+			begin := time.Now()
+			res = process(data, opt.workers)
+			d := time.Since(begin)
+			durations = append(durations, d)
+			fmt.Fprintf(os.Stderr, "run %d: %s\n", i+1, d)
+		}
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		fmt.Fprintf(os.Stderr, "min %s median %s\n", durations[0], durations[len(durations)/2])
+	}
+	finish(res, output)
+}
+
+// prefetchPages touches one byte per page of data in a background
+// goroutine. On a cold page cache each worker otherwise takes its page
+// faults synchronously, serializing disk reads with parsing; the
+// prefetcher keeps read requests in flight ahead of the workers so the
+// faults they do take mostly hit already-resident pages. The returned
+// func stops the goroutine and waits for it to exit, so the region can
+// be unmapped afterwards without racing a page touch; on a warm cache
+// the scan finishes almost immediately and costs nothing measurable.
+func prefetchPages(data []byte) func() {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		pagesize := syscall.Getpagesize()
+		var sink byte
+		for i := 0; i < len(data); i += pagesize {
+			sink += data[i]
+			if i%(1024*pagesize) == 0 {
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}
+		prefetchSink.Store(int64(sink))
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// prefetchSink keeps the compiler from eliding the page-touching loads.
+var prefetchSink atomic.Int64
+
+// processURL streams a remote measurements file without saving it to
+// disk. The http client transparently decompresses Content-Encoding
+// gzip responses; files served as raw gzip bytes are caught by the
+// magic-byte detection.
+func processURL(url string, output io.Writer) {
+	resp, err := http.Get(url)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("GET %s: %s", url, resp.Status)
+	}
+	processStream(maybeGzip(resp.Body), output)
+}
+
+// maybeGzip peeks at the first two bytes of r and transparently
+// decompresses gzip input, so `cat file.gz | calc -` and
+// `zcat file.gz | calc -` behave the same. The peek does not consume
+// bytes from the plain-text path.
+// gzip.Reader runs in multistream mode by default, so concatenated
+// members, as log rotation produces, all decompress in sequence.
+func maybeGzip(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return br
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return zr
+}
+
+func processStream(r io.Reader, output io.Writer) {
+	if opt.startAfter != "" {
+		r = skipPreambleReader(r, opt.startAfter)
+	}
+	a := newAggregator()
+	a.emitEvery = opt.emitRows
+	a.emitTo = output
+	if opt.flushInterval > 0 {
+		a.startFlusher(opt.flushInterval)
+	}
+	if _, err := io.Copy(a, r); err != nil {
+		log.Fatal(err)
+	}
+	a.Close()
+	finish(a.result(), output)
+}
+
+func finish(res measurements, output io.Writer) {
+	if opt.hashStats {
+		reportHashStats(os.Stderr)
+	}
+	if opt.validateUTF8 {
+		validateUTF8(res)
+	}
+	if baselineMeans != nil {
+		applyBaseline(res)
+	}
+	if opt.reportSimilar {
+		reportSimilar(res, os.Stderr)
+	}
+	if opt.loadState != "" {
+		res.merge(loadState(opt.loadState))
+	}
+	if opt.saveState != "" {
+		saveState(res, opt.saveState)
+	}
+	if opt.reservoirOut != "" {
+		writeReservoirs(res, opt.reservoirOut)
+	}
+	if opt.appendFile != "" {
+		appendResult(res, opt.appendFile)
+		return
+	}
+	if opt.partitionDir != "" {
+		writePartitions(res, opt.partitionDir)
+		return
+	}
+
+	var buf bytes.Buffer
+	if opt.groupPrefix != "" {
+		grouped := groupByPrefix(res, opt.groupPrefix)
+		printResult(grouped, &buf)
+		if opt.tee != "" {
+			printResultAs(grouped, os.Stderr, opt.tee)
+		}
+		if !opt.alsoDetail {
+			res = nil
+		}
+	}
+	if res != nil {
+		printResult(res, &buf)
+		if opt.tee != "" {
+			printResultAs(res, os.Stderr, opt.tee)
+		}
+	}
+
+	if opt.writeGolden != "" {
+		if err := os.WriteFile(opt.writeGolden, buf.Bytes(), 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if opt.compare != "" {
+		want, err := os.ReadFile(opt.compare)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			log.Fatalf("result differs from %s", opt.compare)
+		}
+	}
+	if opt.checksum {
+		h := fnv.New64a()
+		h.Write(buf.Bytes())
+		fmt.Fprintf(output, "%016x\n", h.Sum64())
+		return
+	}
+	if _, err := output.Write(buf.Bytes()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// similarKey normalizes a station id for the -report-similar grouping:
+// lowercased, surrounding whitespace trimmed and trailing punctuation
+// stripped, so "London ", "LONDON" and "London." land on one key.
+func similarKey(id string) string {
+	return strings.ToLower(strings.TrimRight(strings.TrimSpace(id), ".,;:!?"))
+}
+
+// similarGroups buckets the raw station ids by similarKey, keeping only
+// keys with more than one raw form.
+func similarGroups(res measurements) map[string][]string {
+	byKey := map[string][]string{}
+	for id := range res {
+		key := similarKey(id)
+		byKey[key] = append(byKey[key], id)
+	}
+	for key, forms := range byKey {
+		if len(forms) < 2 {
+			delete(byKey, key)
+		}
+	}
+	return byKey
+}
+
+// reportSimilar prints likely data-entry duplicates without merging
+// them; deciding whether "London" and "london " are the same station is
+// left to the reader.
+func reportSimilar(res measurements, w io.Writer) {
+	groups := similarGroups(res)
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		forms := groups[key]
+		sort.Strings(forms)
+		fmt.Fprintf(w, "similar station ids: %q\n", forms)
+	}
+}
+
+// baselineMeans holds the -baseline reference means in tenths, keyed by
+// station id.
+var baselineMeans map[string]int64
+
+// loadBaseline reads a json object mapping station ids to baseline mean
+// degrees, e.g. {"London": 10.5}.
+func loadBaseline(path string) map[string]int64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var degrees map[string]float64
+	if err := json.Unmarshal(data, &degrees); err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+	tenths := make(map[string]int64, len(degrees))
+	for id, d := range degrees {
+		tenths[id] = int64(math.Round(d * 10))
+	}
+	return tenths
+}
+
+// applyBaseline turns absolute means into anomalies: each station's sum
+// shifts by its baseline times the count, so the printed mean becomes
+// mean minus baseline while min and max stay absolute unless
+// -anomaly-minmax shifts them too. Stations without a baseline pass
+// through unchanged, or are dropped under -omit-unbaselined.
+func applyBaseline(res measurements) {
+	for id, m := range res {
+		b, ok := baselineMeans[id]
+		if !ok {
+			if opt.omitUnbaselined {
+				delete(res, id)
+			}
+			continue
+		}
+		m.sum -= b * m.count
+		if opt.anomalyMinmax {
+			m.min -= b
+			m.max -= b
+		}
+	}
+}
+
+// validateUTF8 scans every station id for encoding corruption. The fast
+// path stores ids as raw bytes without decoding, so this is the one
+// place a broken byte sequence surfaces before the result lands in a
+// UTF-8-strict downstream system. Each invalid id is reported with the
+// offset of its first bad byte; -skip-invalid-utf8 drops them from the
+// result as well.
+func validateUTF8(res measurements) {
+	invalid := 0
+	for id := range res {
+		off := 0
+		for s := id; s != ""; {
+			r, size := utf8.DecodeRuneInString(s)
+			if r == utf8.RuneError && size == 1 {
+				log.Printf("station %q: invalid UTF-8 at byte %d", id, off)
+				invalid++
+				if opt.skipInvalidUTF8 {
+					delete(res, id)
+				}
+				break
+			}
+			s = s[size:]
+			off += size
+		}
+	}
+	if invalid > 0 {
+		log.Printf("%d station ids are not valid UTF-8", invalid)
+	}
+}
+
+// partitionKey derives the -partition-by key for a station id:
+// "firstchar" takes the first character, "segment" the id up to the
+// first '/' (the whole id when it has none).
+func partitionKey(id string) string {
+	switch opt.partitionBy {
+	case "", "firstchar":
+		for _, r := range id {
+			return string(r)
+		}
+		return id
+	case "segment":
+		key, _, _ := strings.Cut(id, "/")
+		return key
+	default:
+		log.Fatalf("unknown -partition-by %q, supported keys: firstchar, segment", opt.partitionBy)
+		return ""
+	}
+}
+
+// writePartitions routes the result into one file per partition key
+// under dir, each holding its sorted subset of stations in the selected
+// output format.
+func writePartitions(res measurements, dir string) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Fatal(err)
+	}
+	parts := map[string]measurements{}
+	for id, m := range res {
+		key := partitionKey(id)
+		if parts[key] == nil {
+			parts[key] = measurements{}
+		}
+		parts[key][id] = m
+	}
+	for key, part := range parts {
+		f, err := os.Create(filepath.Join(dir, key+".txt"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		printResult(part, f)
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+type measurement struct {
+	min, max, sum, count int64
+	touched              int64 // last-update sequence number, for -spill-dir eviction
+
+	// minAt and maxAt are only populated under -timestamps.
+	minAt, maxAt []byte
+
+	// minRow and maxRow are only populated under -minmax-rows and hold
+	// the 0-based global row index of the first occurrence of the
+	// extreme.
+	minRow, maxRow int64
+
+	// seen is only populated under -dedupe and marks the distinct
+	// temperature values accumulated so far.
+	seen *valueSet
+
+	// values is only populated under -distinct-values. Unlike seen it
+	// does not alter aggregation; it just tracks cardinality.
+	values *valueSet
+
+	// sample is only populated under -reservoir.
+	sample *reservoir
+}
+
+// reservoir keeps a uniform sample of up to -reservoir readings via
+// Algorithm R: the first K readings fill the slots, reading i > K then
+// replaces a random slot with probability K/i.
+type reservoir struct {
+	vals []int64
+	n    int64 // readings offered so far
+	rng  *rand.Rand
+}
+
+// reservoirSeq differentiates the per-station generators, which all
+// derive from -reservoir-seed so runs are reproducible up to scheduling.
+var reservoirSeq atomic.Int64
+
+func newReservoir() *reservoir {
+	return &reservoir{
+		vals: make([]int64, 0, opt.reservoir),
+		rng:  rand.New(rand.NewSource(opt.reservoirSeed + reservoirSeq.Add(1)<<20)),
+	}
+}
+
+func (r *reservoir) add(v int64) {
+	r.n++
+	if len(r.vals) < cap(r.vals) {
+		r.vals = append(r.vals, v)
+		return
+	}
+	if j := r.rng.Int63n(r.n); j < int64(len(r.vals)) {
+		r.vals[j] = v
+	}
+}
+
+// merge folds another chunk's reservoir in. Each merged slot draws from
+// the two samples in proportion to the readings they stand for, keeping
+// the union sample close to uniform.
+func (r *reservoir) merge(o *reservoir) {
+	if o.n == 0 {
+		return
+	}
+	total := r.n + o.n
+	if total <= int64(cap(r.vals)) {
+		r.vals = append(r.vals, o.vals...)
+		r.n = total
+		return
+	}
+	k := cap(r.vals)
+	merged := make([]int64, 0, k)
+	for i := 0; i < k; i++ {
+		if r.rng.Int63n(total) < r.n {
+			merged = append(merged, r.vals[r.rng.Intn(len(r.vals))])
+		} else {
+			merged = append(merged, o.vals[r.rng.Intn(len(o.vals))])
+		}
+	}
+	r.vals, r.n = merged, total
+}
+
+// valueSet is a bitset over the 1999 possible temperature tenths,
+// offset by +999. Under -dedupe it fully determines the aggregate, so
+// merging two deduplicated measurements unions the sets and recomputes.
+type valueSet [(2*999 + 1 + 63) / 64]uint64
+
+// distinct is the number of values inserted so far.
+func (s *valueSet) distinct() int64 {
+	var n int64
+	for _, w := range s {
+		n += int64(bits.OnesCount64(w))
+	}
+	return n
+}
+
+// insert marks v and reports whether it was new. Raw readings always
+// fit the bitset; -offset-tenths and -quantize adjustments can move a
+// value outside it, which must fail loudly rather than corrupt the set.
+func (s *valueSet) insert(v int64) bool {
+	idx := v + 999
+	if idx < 0 || idx >= int64(len(s)*64) {
+		log.Fatalf("value %.1f is outside the domain -dedupe and -distinct-values track; -offset-tenths/-quantize moved it past ±99.9", float64(v)/10)
+	}
+	bit := uint64(1) << (idx & 63)
+	if s[idx>>6]&bit != 0 {
+		return false
+	}
+	s[idx>>6] |= bit
+	return true
+}
+
+// adjustTenths applies the record-layer value adjustments, in order: the
+// -offset-tenths bias correction, then -quantize snapping to the nearest
+// grid multiple with ties rounding away from zero.
+func adjustTenths(v int64) int64 {
+	v += opt.offsetTenths
+	if q := opt.quantize; q > 1 {
+		if v >= 0 {
+			v = (v + q/2) / q * q
+		} else {
+			v = -((-v + q/2) / q * q)
+		}
+	}
+	return v
+}
+
+func newMeasurement(v int64) *measurement {
+	m := &measurement{min: v, max: v, sum: v, count: 1}
+	if opt.dedupe {
+		m.seen = new(valueSet)
+		m.seen.insert(v)
+	}
+	if opt.distinctValues {
+		m.values = new(valueSet)
+		m.values.insert(v)
+	}
+	if opt.reservoir > 0 {
+		m.sample = newReservoir()
+		m.sample.add(v)
+	}
+	return m
+}
+
+func (m *measurement) add(v int64) {
+	if m.values != nil {
+		m.values.insert(v)
+	}
+	if m.sample != nil {
+		m.sample.add(v)
+	}
+	if m.seen != nil && !m.seen.insert(v) {
+		return
+	}
+	if v < m.min {
+		m.min = v
+	}
+	if v > m.max {
+		m.max = v
+	}
+	m.sum += v
+	m.count++
+}
+
+// addAt is add for -timestamps, tracking when new extremes occur.
+func (m *measurement) addAt(v int64, ts []byte) {
+	if v < m.min {
+		m.min = v
+		m.minAt = ts
+	}
+	if v > m.max {
+		m.max = v
+		m.maxAt = ts
+	}
+	m.sum += v
+	m.count++
+}
+
+// addWeighted is add for -weighted: the row stands for weight samples
+// averaging v, so the sum and count scale by the weight while min and
+// max use the temperature directly.
+func (m *measurement) addWeighted(v, weight int64) {
+	if v < m.min {
+		m.min = v
+	}
+	if v > m.max {
+		m.max = v
+	}
+	m.sum += v * weight
+	m.count += weight
+}
+
+// addRow is add for -minmax-rows, tracking the row index of new
+// extremes. Strict comparisons keep the first occurrence.
+func (m *measurement) addRow(v, row int64) {
+	if v < m.min {
+		m.min = v
+		m.minRow = row
+	}
+	if v > m.max {
+		m.max = v
+		m.maxRow = row
+	}
+	m.sum += v
+	m.count++
+}
+
+// mergeSeen unions two deduplicated measurements: parallel chunks may
+// each have counted the same value as first, so the aggregate is
+// recomputed from the combined set.
+func (m *measurement) mergeSeen(o *measurement) {
+	m.min, m.max, m.sum, m.count = 0, 0, 0, 0
+	for i := range m.seen {
+		m.seen[i] |= o.seen[i]
+		for w := m.seen[i]; w != 0; w &= w - 1 {
+			v := int64(i*64+bits.TrailingZeros64(w)) - 999
+			if m.count == 0 || v < m.min {
+				m.min = v
+			}
+			if m.count == 0 || v > m.max {
+				m.max = v
+			}
+			m.sum += v
+			m.count++
+		}
+	}
+}
+
+func (m *measurement) merge(o *measurement) {
+	if m.values != nil && o.values != nil {
+		for i := range m.values {
+			m.values[i] |= o.values[i]
+		}
+	}
+	if m.sample != nil && o.sample != nil {
+		m.sample.merge(o.sample)
+	}
+	if m.seen != nil && o.seen != nil {
+		m.mergeSeen(o)
+		return
+	}
+	if o.min < m.min {
+		m.min = o.min
+		m.minAt = o.minAt
+		m.minRow = o.minRow
+	}
+	if o.max > m.max {
+		m.max = o.max
+		m.maxAt = o.maxAt
+		m.maxRow = o.maxRow
+	}
+	m.sum += o.sum
+	m.count += o.count
+}
+
+type measurements map[string]*measurement
+
+func (res measurements) record(id []byte, v int64) {
+	v = adjustTenths(v)
+	defer touch(res, id)
+	if m := res[string(id)]; m != nil {
+		m.add(v)
+	} else {
+		res[string(id)] = newMeasurement(v)
+	}
+}
+
+func (res measurements) recordWeighted(id []byte, v, weight int64) {
+	v = adjustTenths(v)
+	defer touch(res, id)
+	if m := res[string(id)]; m != nil {
+		m.addWeighted(v, weight)
+	} else {
+		res[string(id)] = &measurement{min: v, max: v, sum: v * weight, count: weight}
+	}
+}
+
+func (res measurements) recordRow(id []byte, v, row int64) {
+	v = adjustTenths(v)
+	defer touch(res, id)
+	if m := res[string(id)]; m != nil {
+		m.addRow(v, row)
+	} else {
+		res[string(id)] = &measurement{min: v, max: v, sum: v, count: 1, minRow: row, maxRow: row}
+	}
+}
+
+func (res measurements) recordAt(id []byte, v int64, ts []byte) {
+	v = adjustTenths(v)
+	defer touch(res, id)
+	if m := res[string(id)]; m != nil {
+		m.addAt(v, ts)
+	} else {
+		res[string(id)] = &measurement{min: v, max: v, sum: v, count: 1, minAt: ts, maxAt: ts}
+	}
+}
+
+func (res measurements) mergeOne(id []byte, m *measurement) {
+	if ex := res[string(id)]; ex != nil {
+		ex.merge(m)
+	} else {
+		c := *m
+		res[string(id)] = &c
+	}
+}
+
+func (res measurements) clone() measurements {
+	c := make(measurements, len(res))
+	for id, m := range res {
+		mm := *m
+		c[id] = &mm
+	}
+	return c
+}
+
+func (res measurements) merge(other measurements) {
+	for id, m := range other {
+		if ex := res[id]; ex != nil {
+			ex.merge(m)
+		} else {
+			res[id] = m
+		}
+	}
+}
+
+// groupByPrefix rolls stations up by their id prefix before the first
+// occurrence of sep, combining the grouped measurements; ids without sep
+// group under themselves.
+func groupByPrefix(res measurements, sep string) measurements {
+	grouped := measurements{}
+	for id, m := range res {
+		key := id
+		if i := strings.Index(id, sep); i != -1 {
+			key = id[:i]
+		}
+		grouped.mergeOne([]byte(key), m)
+	}
+	return grouped
+}
+
+// displayID is the key a raw station id aggregates and prints under.
+// With -normalize distinct raw forms may collapse into one key; using the
+// normalized form itself keeps the result independent of input order.
+func displayID(id []byte) []byte {
+	raw := id
+	if opt.normalize {
+		id = normalizeID(id)
+	}
+	if opt.caseFold {
+		if opt.assumeASCII {
+			id = lowerASCII(id)
+		} else {
+			id = bytes.ToLower(id)
+		}
+	}
+	if opt.truncateNames > 0 {
+		if opt.assumeASCII {
+			id = truncateName(id, opt.truncateNames)
+		} else {
+			id = truncateRunes(id, opt.truncateNames)
+		}
+	}
+	if opt.warnMerges {
+		noteRawForm(raw, id)
+	}
+	return id
+}
+
+// truncateName cuts id to at most n bytes without splitting a UTF-8
+// sequence: the cut backs up over continuation bytes to the preceding
+// rune boundary, so truncated ids stay valid UTF-8 when the input was.
+func truncateName(id []byte, n int) []byte {
+	if len(id) <= n {
+		return id
+	}
+	for n > 0 && id[n]&0xc0 == 0x80 {
+		n--
+	}
+	return id[:n]
+}
+
+// truncateRunes is truncateName under -assume-ascii=false: the limit
+// counts runes rather than bytes, matching what a reader perceives as
+// the name length. Invalid bytes count as one rune each, like the
+// replacement characters they would display as.
+func truncateRunes(id []byte, n int) []byte {
+	i := 0
+	for ; n > 0 && i < len(id); n-- {
+		_, size := utf8.DecodeRune(id[i:])
+		i += size
+	}
+	return id[:i]
+}
+
+// rawForms tracks, under -warn-merges, the raw ids seen per display key.
+// The per-key sets cost memory proportional to the distinct raw forms,
+// which is why the tracking is flag-gated.
+var rawForms struct {
+	mu    sync.Mutex
+	forms map[string][]string
+}
+
+// noteRawForm warns on stderr the first time a distinct raw id collapses
+// into a display key already produced by another raw form, to catch
+// unintended merges under -normalize or -ci.
+func noteRawForm(raw, display []byte) {
+	rawForms.mu.Lock()
+	defer rawForms.mu.Unlock()
+	if rawForms.forms == nil {
+		rawForms.forms = map[string][]string{}
+	}
+	seen := rawForms.forms[string(display)]
+	for _, r := range seen {
+		if r == string(raw) {
+			return
+		}
+	}
+	if len(seen) > 0 {
+		log.Printf("raw id %q merges into %q, first seen as %q", raw, display, seen[0])
+	}
+	rawForms.forms[string(display)] = append(seen, string(raw))
+}
+
+func normalizeID(id []byte) []byte {
+	return bytes.Trim(id, " \t")
+}
+
+// lowerASCII lowercases ASCII letters, copying only when needed. Non-ASCII
+// bytes pass through untouched: Unicode case folding would require decoding
+// the id and is out of scope for -ci.
+func lowerASCII(id []byte) []byte {
+	isUpper := func(c byte) bool { return 'A' <= c && c <= 'Z' }
+	i := 0
+	for i < len(id) && !isUpper(id[i]) {
+		i++
+	}
+	if i == len(id) {
+		return id
+	}
+	lowered := append([]byte{}, id...)
+	for ; i < len(lowered); i++ {
+		if isUpper(lowered[i]) {
+			lowered[i] += 'a' - 'A'
+		}
+	}
+	return lowered
+}
+
+// chunkOverlap is the number of bytes the 8-byte read of a chunk's last
+// temperature may extend past the chunk end: the shortest row tail is
+// ";1.2\n" so at most 4 of the 8 bytes after ';' belong to the next chunk.
+// The id length never enters this bound — chunks end on newlines, so an
+// id of any size, kilobytes included, lies entirely inside its chunk and
+// only the fixed-size temperature tail can straddle the seam.
+const chunkOverlap = 4
+
+// assertOverlap verifies under -debug that an 8-byte number read starting
+// at i stays within chunkOverlap bytes past the chunk end. The constant
+// is derived from the shortest possible row tail, so a parser variant
+// that accepts wider numbers would silently invalidate it; this assertion
+// turns that into a loud failure instead of a cross-chunk misparse.
+func assertOverlap(i, end int) {
+	if excess := i + 8 - end; excess > chunkOverlap {
+		log.Fatalf("chunk overlap exceeded: number read at offset %d needs %d bytes past the chunk end %d, chunkOverlap is %d",
+			i, excess, end, chunkOverlap)
+	}
+}
+
+// rowsConsumed is the shared row budget counter for -limit.
+var rowsConsumed atomic.Int64
+
+// touchSeq orders station updates for -spill-dir eviction.
+var touchSeq atomic.Int64
+
+// touch stamps the station's last-update sequence number so the spill
+// eviction can pick the least-recently-updated stations. A no-op unless
+// -spill-dir is set.
+func touch(res measurements, id []byte) {
+	if opt.spillDir == "" {
+		return
+	}
+	if m := res[string(id)]; m != nil {
+		m.touched = touchSeq.Add(1)
+	}
+}
+
+// verbosef logs benchmark-relevant context to stderr under -verbose.
+func verbosef(format string, args ...any) {
+	if opt.verbose {
+		log.Printf(format, args...)
+	}
+}
+
+// limitReached consumes one row of the -limit budget and reports whether it
+// is exhausted. Every worker claims rows through the shared atomic counter,
+// so exactly limit rows are aggregated in total; which rows those are
+// depends on chunk scheduling.
+func limitReached() bool {
+	return opt.limit > 0 && rowsConsumed.Add(1) > opt.limit
+}
+
+func process(data []byte, workers int) measurements {
+	res, _ := processContext(context.Background(), data, workers)
+	return res
+}
+
+// ProcessContext is process for embedding, with cooperative
+// cancellation: workers observe ctx at chunk granularity, not per row,
+// and the result is nil with ctx.Err() once cancelled.
+//
+// Concurrent calls with the default options are independent: each call
+// builds its own chunk tables and result map. Flag-gated modes that
+// keep package state are the exception and must not run concurrently:
+// -limit shares its row counter, -use-header reconfigures the parser,
+// and -hash-stats and -warn-merges accumulate across runs.
+func ProcessContext(ctx context.Context, data []byte) (Result, error) {
+	res, err := processContext(ctx, data, opt.workers)
+	return Result(res), err
+}
+
+// Aggregator accumulates pre-parsed (station, tenths) pairs in the same
+// chained hash table the text path uses, for embedders whose data never
+// was `station;temperature` text, e.g. a columnar store. Add retains id,
+// so callers reusing a buffer must pass a copy. An Aggregator is not
+// safe for concurrent use; shard across goroutines and combine with
+// Merge instead, mirroring the per-chunk tables of the parallel loop.
+type Aggregator struct {
+	t *chunkTable
+}
+
+func NewAggregator() *Aggregator {
+	return &Aggregator{t: newChunkTable()}
+}
+
+// Add records one reading of tenths of a degree for the station id.
+func (a *Aggregator) Add(id []byte, tenths int64) {
+	a.t.record(id, fnvHash(id), tenths)
+}
+
+// Merge folds the other Aggregator's stations into a.
+func (a *Aggregator) Merge(o *Aggregator) {
+	for idx, id := range o.t.ids {
+		a.t.mergeRecord(id, o.t.hashes[idx], &o.t.ms[idx])
+	}
+}
+
+// Result returns the aggregation keyed by display id.
+func (a *Aggregator) Result() Result {
+	return Result(a.t.result())
+}
+
+// Result is a finished aggregation for library users. String yields the
+// challenge's brace format and MarshalJSON one json object per station
+// with sorted keys and rounded floats, so embedders get either
+// representation without touching the writer-based printers.
+type Result map[string]*measurement
+
+func (r Result) String() string {
+	var buf bytes.Buffer
+	printResultAs(measurements(r), &buf, "brace")
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func (r Result) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	printResultAs(measurements(r), &buf, "json")
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), nil
+}
+
+// skipPreamble drops everything up to and including the first line that
+// equals the -start-after marker. The preamble can be arbitrary, so only
+// a whole-line match counts, not a marker embedded mid-line.
+func skipPreamble(data []byte, marker string) []byte {
+	m := []byte(marker + "\n")
+	for i := 0; ; {
+		j := bytes.Index(data[i:], m)
+		if j == -1 {
+			log.Fatalf("-start-after marker %q not found", marker)
+		}
+		j += i
+		if j == 0 || data[j-1] == '\n' {
+			return data[j+len(m):]
+		}
+		i = j + 1
+	}
+}
+
+// skipPreambleReader is skipPreamble for streams.
+func skipPreambleReader(r io.Reader, marker string) io.Reader {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if strings.TrimSuffix(line, "\n") == marker {
+			return br
+		}
+		if err != nil {
+			log.Fatalf("-start-after marker %q not found", marker)
+		}
+	}
+}
+
+// explainRows prints how the parser reads the first n rows: the id
+// bytes, the raw temperature bytes, the parsed tenths and the bytes the
+// number parser consumed. It is the debug dump inside parseNumberLE
+// turned into a flag, run once up front so the hot loop itself stays
+// free of instrumentation.
+func explainRows(data []byte, n int, w io.Writer) {
+	i := 0
+	for row := 1; row <= n && i < len(data); row++ {
+		nl := bytes.IndexByte(data[i:], '\n')
+		if nl == -1 {
+			nl = len(data) - i
+		}
+		sep := bytes.IndexByte(data[i:i+nl], ';')
+		if sep == -1 {
+			fmt.Fprintf(w, "row %d: %q: no ';' separator\n", row, data[i:i+nl])
+			i += nl + 1
+			continue
+		}
+		id := data[i : i+sep]
+		temp := data[i+sep+1 : i+nl]
+		var v int64
+		var consumed int
+		if i+sep+1+8 <= len(data) {
+			v, consumed = parseNumberLE(binary.LittleEndian.Uint64(data[i+sep+1:]))
+		} else {
+			v = parseNumber(temp)
+			consumed = len(temp) + 1
+		}
+		fmt.Fprintf(w, "row %d: id=%q temp=%q tenths=%d consumed=%d\n", row, id, temp, v, consumed)
+		i += nl + 1
+	}
+}
+
+// applyHeader configures the parser from a leading schema header like
+// `#station;temperature` or `#station;temp;humidity` and returns data
+// with the header line stripped. The station column may come first or
+// second; the column after it is the temperature and any further
+// columns are ignored, so multi-column exports aggregate without
+// flags spelling the layout out.
+func applyHeader(data []byte) []byte {
+	nl := bytes.IndexByte(data, '\n')
+	if len(data) == 0 || data[0] != '#' || nl == -1 {
+		log.Fatalf("-use-header: input does not start with a '#name;name...' header line")
+	}
+	names := strings.Split(string(data[1:nl]), ";")
+	switch {
+	case len(names) >= 2 && names[0] == "station":
+		opt.order = "station-first"
+		opt.extraFields = len(names) - 2
+	case len(names) == 2 && names[1] == "station":
+		opt.order = "temp-first"
+		opt.extraFields = 0
+	default:
+		log.Fatalf("-use-header: unsupported schema %q; the station column must be first or, for two columns, second", names)
+	}
+	verbosef("header: %d columns, order=%s, %d extra fields", len(names), opt.order, opt.extraFields)
+	return data[nl+1:]
+}
+
+// defaultGrammar reports whether rows follow the plain
+// `station;temperature` grammar: no quoting, extra fields, alternate
+// separators or non-standard temperature forms.
+func defaultGrammar() bool {
+	return !opt.quotedIds && !opt.timestamps && !opt.scientific && opt.nullValue == "" &&
+		opt.signToken == "" && sepTable == nil && !opt.weighted && !opt.unicodeMinus &&
+		opt.extraFields == 0
+}
+
+// runReport is the -run-report artifact: one json object describing the
+// completed run, for dashboards around batch jobs. Rows count recorded
+// readings, so excluded stations and skipped rows do not appear in them.
+type runReport struct {
+	InputBytes       int         `json:"inputBytes"`
+	Workers          int         `json:"workers"`
+	Chunks           []chunkStat `json:"chunks"`
+	TotalRows        int64       `json:"totalRows"`
+	DistinctStations int         `json:"distinctStations"`
+	SplitMicros      int64       `json:"splitMicros"`
+	ProcessMicros    int64       `json:"processMicros"`
+}
+
+type chunkStat struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Bytes int64 `json:"bytes"`
+	Rows  int64 `json:"rows"`
+}
+
+func writeRunReport(path string, report *runReport) {
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(buf, '\n'), 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func processContext(ctx context.Context, data []byte, workers int) (measurements, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// Strip a UTF-8 byte order mark, as written by some Windows tools,
+	// so it does not become part of the first station's id.
+	data = bytes.TrimPrefix(data, []byte{0xef, 0xbb, 0xbf})
+
+	if opt.startAfter != "" {
+		data = skipPreamble(data, opt.startAfter)
+	}
+
+	if opt.useHeader {
+		data = applyHeader(data)
+	}
+
+	if opt.explain > 0 {
+		explainRows(data, opt.explain, os.Stderr)
+	}
+
+	if opt.fixed != "" {
+		return processFixed(data, workers), nil
+	}
+	// A file of only newlines or whitespace holds no rows.
+	if len(bytes.TrimSpace(data)) == 0 {
+		return measurements{}, nil
+	}
+	// The -limit row counter is package state so the parallel workers
+	// can share it; reset it only when used, keeping concurrent default
+	// runs free of cross-call writes.
+	if opt.limit > 0 {
+		rowsConsumed.Store(0)
+	}
+
+	// The final row may lack a trailing newline, parse it separately.
+	last := bytes.LastIndexByte(data[:len(data)-1], '\n')
+	head, tailRow := data[:last+1], data[last+1:]
+
+	// A file truncated mid-write leaves a fragment like "Lon", "London;"
+	// or "London;1" as the final row; parsing it would fabricate a
+	// reading (a truncated "12.3" reads as 1.0), so drop it with a
+	// warning instead. Only the default grammar is checkable this way;
+	// the row variants are validated by their own parsers.
+	if defaultGrammar() && !opt.stripSuffix && !opt.strict && opt.order != "temp-first" &&
+		len(bytes.TrimSpace(tailRow)) > 0 {
+		if _, _, ok := validRow(bytes.TrimSuffix(tailRow, []byte{'\n'})); !ok {
+			log.Printf("dropping truncated final row %q", tailRow)
+			tailRow = nil
+		}
+	}
+
+	splitBegin := time.Now()
+	chunks := splitChunks(head, workers)
+	splitDone := time.Now()
+	verbosef("workers=%d GOMAXPROCS=%d chunks=%d chunkSize~%d chunkOverlap=%d",
+		workers, runtime.GOMAXPROCS(0), len(chunks), len(head)/max(len(chunks), 1), chunkOverlap)
+
+	var report *runReport
+	if opt.runReport != "" {
+		report = &runReport{
+			InputBytes:  len(data),
+			Workers:     workers,
+			SplitMicros: splitDone.Sub(splitBegin).Microseconds(),
+		}
+		for _, c := range chunks {
+			report.Chunks = append(report.Chunks, chunkStat{
+				Start: int64(c.start),
+				End:   int64(c.end),
+				Bytes: int64(c.end - c.start),
+			})
+		}
+	}
+	if opt.minmaxRows {
+		return processRows(data, chunks, tailRow), nil
+	}
+
+	chunkFunc := fastChunkFunc
+	if opt.swarIds {
+		chunkFunc = processChunkSWAR
+	}
+	if opt.sortedInput {
+		chunkFunc = processChunkSorted
+	}
+	if !defaultGrammar() {
+		chunkFunc = processChunkScalar
+	}
+	if opt.strict {
+		chunkFunc = processChunkStrict
+	}
+	if opt.order == "temp-first" {
+		chunkFunc = processChunkTempFirst
+	}
+
+	// Chunks deliver their partial maps over a channel so merging can
+	// start while later chunks still parse. The merger buffers partials
+	// that arrive early and folds them in strictly in chunk order, so the
+	// output stays identical to the sequential merge even for
+	// order-sensitive ties like -timestamps extremes.
+	type partial struct {
+		i   int
+		res measurements
+	}
+	parts := make(chan partial, len(chunks))
+	for i, c := range chunks {
+		go func(i int, c chunk) {
+			if ctx.Err() != nil {
+				parts <- partial{i, nil}
+				return
+			}
+			parts <- partial{i, chunkFunc(data, c.start, c.end)}
+		}(i, c)
+	}
+
+	tail := measurements{}
+	if len(bytes.TrimSpace(tailRow)) > 0 && !limitReached() {
+		parseRow(tailRow, tail)
+	}
+
+	res := measurements{}
+	pending := make([]measurements, len(chunks))
+	arrived := make([]bool, len(chunks))
+	// Under -debug the partials are also merged in reverse order and the
+	// two results compared; merge adopts pointers from its argument, so
+	// the copies must be taken before the forward merge mutates them.
+	var kept []measurements
+	if opt.debug {
+		kept = make([]measurements, len(chunks))
+	}
+	next := 0
+	for received := 0; received < len(chunks); received++ {
+		p := <-parts
+		pending[p.i], arrived[p.i] = p.res, true
+		if kept != nil {
+			kept[p.i] = copyMeasurements(p.res)
+		}
+		if report != nil {
+			for _, m := range p.res {
+				report.Chunks[p.i].Rows += m.count
+			}
+		}
+		for next < len(chunks) && arrived[next] {
+			res.merge(pending[next])
+			pending[next] = nil
+			next++
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if kept != nil {
+		verifyReverseMerge(res, kept, tail)
+	}
+	res.merge(tail)
+	if report != nil {
+		for _, m := range tail {
+			report.TotalRows += m.count
+		}
+		for _, c := range report.Chunks {
+			report.TotalRows += c.Rows
+		}
+		report.DistinctStations = len(res)
+		report.ProcessMicros = time.Since(splitDone).Microseconds()
+		writeRunReport(opt.runReport, report)
+	}
+	return res, nil
+}
+
+// copyMeasurements deep-copies a partial so the original can keep being
+// mutated by merges.
+func copyMeasurements(res measurements) measurements {
+	out := make(measurements, len(res))
+	for id, m := range res {
+		c := *m
+		if m.seen != nil {
+			c.seen = new(valueSet)
+			*c.seen = *m.seen
+		}
+		if m.values != nil {
+			c.values = new(valueSet)
+			*c.values = *m.values
+		}
+		out[id] = &c
+	}
+	return out
+}
+
+// verifyReverseMerge re-merges the chunk partials back to front and
+// compares min/max/sum/count against the forward result. Those four are
+// commutative and associative by construction, so any difference means a
+// code path made them order-dependent; order-sensitive extras like the
+// -timestamps tie-breaking are deliberately not compared.
+func verifyReverseMerge(res measurements, kept []measurements, tail measurements) {
+	rev := copyMeasurements(tail)
+	for i := len(kept) - 1; i >= 0; i-- {
+		rev.merge(kept[i])
+	}
+	forward := copyMeasurements(res)
+	forward.merge(copyMeasurements(tail))
+	if len(rev) != len(forward) {
+		log.Fatalf("reverse merge drift: %d stations forward, %d reverse", len(forward), len(rev))
+	}
+	for id, m := range forward {
+		o := rev[id]
+		if o == nil {
+			log.Fatalf("reverse merge drift: station %q missing", id)
+		}
+		if o.min != m.min || o.max != m.max || o.sum != m.sum || o.count != m.count {
+			log.Fatalf("reverse merge drift for %q: forward %d/%d/%d/%d, reverse %d/%d/%d/%d",
+				id, m.min, m.max, m.sum, m.count, o.min, o.max, o.sum, o.count)
+		}
+	}
+}
+
+// parseFixedSpec parses the -fixed value, e.g. "id=32,temp=6", into the
+// two field widths.
+func parseFixedSpec(spec string) (idLen, tempLen int) {
+	for _, field := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(field, "=")
+		n, err := strconv.Atoi(value)
+		if !ok || err != nil || n <= 0 {
+			log.Fatalf("invalid -fixed field %q", field)
+		}
+		switch name {
+		case "id":
+			idLen = n
+		case "temp":
+			tempLen = n
+		default:
+			log.Fatalf("invalid -fixed field %q", field)
+		}
+	}
+	if idLen == 0 || tempLen == 0 {
+		log.Fatalf("-fixed must specify id and temp widths, e.g. id=32,temp=6")
+	}
+	return idLen, tempLen
+}
+
+// processFixed aggregates fixed-width records: idLen bytes station padded
+// with trailing spaces, tempLen bytes temperature, no separators or
+// newlines. Records parallelize on record-count boundaries, so no
+// boundary splitting is needed.
+func processFixed(data []byte, workers int) measurements {
+	idLen, tempLen := parseFixedSpec(opt.fixed)
+	recLen := idLen + tempLen
+	if len(data)%recLen != 0 {
+		log.Fatalf("input size %d is not a multiple of the %d byte record length", len(data), recLen)
+	}
+	records := len(data) / recLen
+
+	perWorker := records/workers + 1
+	results := make([]measurements, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			res := measurements{}
+			for r := w * perWorker; r < min((w+1)*perWorker, records); r++ {
+				rec := data[r*recLen : (r+1)*recLen]
+				id := bytes.TrimRight(rec[:idLen], " ")
+				temp := bytes.TrimSpace(rec[idLen:])
+				if missingTemp(temp) || limitReached() {
+					continue
+				}
+				res.record(displayID(id), parseTemp(temp))
+			}
+			results[w] = res
+		}(w)
+	}
+	wg.Wait()
+
+	res := measurements{}
+	for _, r := range results {
+		res.merge(r)
+	}
+	return res
+}
+
+// processRows is the -minmax-rows variant of the parallel loop. Each
+// chunk counts its rows and records chunk-relative indices; since the
+// chunks partition the file in order, a prefix sum of the counts yields
+// each chunk's starting global row number, which offsets its indices
+// before the merge.
+func processRows(data []byte, chunks []chunk, tailRow []byte) measurements {
+	results := make([]measurements, len(chunks))
+	rows := make([]int64, len(chunks))
+
+	var wg sync.WaitGroup
+	for i, c := range chunks {
+		wg.Add(1)
+		go func(i int, c chunk) {
+			defer wg.Done()
+			results[i], rows[i] = processChunkRows(data, c.start, c.end)
+		}(i, c)
+	}
+	wg.Wait()
+
+	res := measurements{}
+	var rowBase int64
+	for i, r := range results {
+		for _, m := range r {
+			m.minRow += rowBase
+			m.maxRow += rowBase
+		}
+		res.merge(r)
+		rowBase += rows[i]
+	}
+
+	if len(bytes.TrimSpace(tailRow)) > 0 && !limitReached() {
+		row := bytes.TrimSuffix(tailRow, []byte{'\n'})
+		sep := bytes.IndexByte(row, ';')
+		if sep == -1 {
+			log.Fatalf("invalid row %q", row)
+		}
+		if temp := row[sep+1:]; !missingTemp(temp) {
+			res.recordRow(displayID(row[:sep]), parseTemp(temp), rowBase)
+		}
+	}
+	return res
+}
+
+// processChunkRows aggregates one chunk while numbering its rows,
+// returning the partial result with chunk-relative indices and the
+// number of rows seen. Every input line counts as a row, including ones
+// with a missing reading.
+func processChunkRows(data []byte, start, end int) (measurements, int64) {
+	res := measurements{}
+	var rows int64
+	for i := start; i < end; {
+		nl := bytes.IndexByte(data[i:end], '\n')
+		row := data[i : i+nl]
+		i += nl + 1
+
+		sep := bytes.IndexByte(row, ';')
+		if sep == -1 {
+			log.Fatalf("invalid row %q", row)
+		}
+		if temp := row[sep+1:]; !missingTemp(temp) && !limitReached() {
+			res.recordRow(displayID(row[:sep]), parseTemp(temp), rows)
+		}
+		rows++
+	}
+	return res, rows
+}
+
+type chunk struct {
+	start, end int
+}
+
+// splitChunks cuts data into at most n chunks of roughly equal size,
+// each ending on a newline.
+func splitChunks(data []byte, n int) []chunk {
+	chunkSize := len(data) / n
+	if chunkSize == 0 {
+		chunkSize = len(data)
+	}
+
+	var chunks []chunk
+	start := 0
+	for start < len(data) {
+		end := start + chunkSize
+		if end >= len(data) {
+			end = len(data)
+		} else {
+			end += bytes.IndexByte(data[end:], '\n') + 1
+		}
+		chunks = append(chunks, chunk{start, end})
+		start = end
+	}
+	return chunks
+}
+
+// excludeSet maps FNV-1a hashes of -exclude-file ids to the ids
+// themselves, so the hot loop can reject a row with a single map probe
+// plus a byte comparison on hash collision.
+var excludeSet map[uint64]string
+
+func loadExclude(path string) map[uint64]string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	set := map[uint64]string{}
+	for _, id := range strings.Split(string(data), "\n") {
+		if id != "" {
+			set[fnvHash([]byte(id))] = id
+		}
+	}
+	return set
+}
+
+func isExcluded(id []byte, hash uint64) bool {
+	x, ok := excludeSet[hash]
+	return ok && x == string(id)
+}
+
+func fnvHash(b []byte) uint64 {
+	hash := uint64(offset64)
+	for _, c := range b {
+		hash ^= uint64(c)
+		hash *= prime64
+	}
+	return hash
+}
+
+const (
+	// FNV-1a
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+
+	nBuckets = 1 << 16
+	maxIds   = 10000
+)
+
+// chunkTable is the chained hash table a chunk accumulates into, pre-sized
+// for the challenge's station cardinality to avoid map overhead in the hot
+// loop; the buckets double once the id count outgrows them so chains stay
+// short.
+type chunkTable struct {
+	buckets [][]int32
+	mask    uint64
+	ids     [][]byte
+	hashes  []uint64
+	ms      []measurement
+}
+
+func newChunkTable() *chunkTable {
+	return &chunkTable{
+		buckets: make([][]int32, nBuckets),
+		mask:    uint64(nBuckets - 1),
+		ids:     make([][]byte, 0, maxIds),
+		hashes:  make([]uint64, 0, maxIds),
+		ms:      make([]measurement, 0, maxIds),
+	}
+}
+
+func (t *chunkTable) grow() {
+	t.buckets = make([][]int32, 2*len(t.buckets))
+	t.mask = uint64(len(t.buckets) - 1)
+	for idx, h := range t.hashes {
+		k := h & t.mask
+		t.buckets[k] = append(t.buckets[k], int32(idx))
+	}
+}
+
+func (t *chunkTable) record(id []byte, hash uint64, v int64) {
+	// The exclude set is keyed by FNV-1a, which -swar-ids does not use
+	// for the table hash, so recompute rather than reuse hash.
+	if excludeSet != nil && isExcluded(id, fnvHash(id)) {
+		return
+	}
+	v = adjustTenths(v)
+	k := hash & t.mask
+	var m *measurement
+	for _, idx := range t.buckets[k] {
+		if bytes.Equal(t.ids[idx], id) {
+			m = &t.ms[idx]
+			break
+		}
+	}
+	if m != nil {
+		m.add(v)
+		return
+	}
+	if len(t.ids) >= opt.maxStations {
+		log.Fatalf("station %q exceeds the -max-stations cap of %d", id, opt.maxStations)
+	}
+	if 2*len(t.ids) >= len(t.buckets) {
+		t.grow()
+		k = hash & t.mask
+	}
+	t.buckets[k] = append(t.buckets[k], int32(len(t.ids)))
+	t.ids = append(t.ids, id)
+	t.hashes = append(t.hashes, hash)
+	t.ms = append(t.ms, *newMeasurement(v))
+}
+
+// mergeRecord is record for an already aggregated measurement, used by
+// Aggregator.Merge: the whole aggregate folds in instead of one value.
+func (t *chunkTable) mergeRecord(id []byte, hash uint64, m *measurement) {
+	k := hash & t.mask
+	for _, idx := range t.buckets[k] {
+		if bytes.Equal(t.ids[idx], id) {
+			t.ms[idx].merge(m)
+			return
+		}
+	}
+	if len(t.ids) >= opt.maxStations {
+		log.Fatalf("station %q exceeds the -max-stations cap of %d", id, opt.maxStations)
+	}
+	if 2*len(t.ids) >= len(t.buckets) {
+		t.grow()
+		k = hash & t.mask
+	}
+	t.buckets[k] = append(t.buckets[k], int32(len(t.ids)))
+	t.ids = append(t.ids, id)
+	t.hashes = append(t.hashes, hash)
+	t.ms = append(t.ms, *m)
+}
+
+// chainLengths collects the bucket chain lengths of every chunk table
+// under -hash-stats; long chains mean nBuckets is too small for the
+// input's cardinality.
+var chainLengths struct {
+	mu      sync.Mutex
+	lengths []int
+}
+
+func (t *chunkTable) collectChainLengths() {
+	lengths := make([]int, len(t.buckets))
+	for i, b := range t.buckets {
+		lengths[i] = len(b)
+	}
+	chainLengths.mu.Lock()
+	chainLengths.lengths = append(chainLengths.lengths, lengths...)
+	chainLengths.mu.Unlock()
+}
+
+// reportHashStats prints the max, mean and p99 chain length over all
+// buckets of all chunk tables, including empty ones.
+func reportHashStats(w io.Writer) {
+	chainLengths.mu.Lock()
+	lengths := chainLengths.lengths
+	chainLengths.mu.Unlock()
+	if len(lengths) == 0 {
+		return
+	}
+
+	sort.Ints(lengths)
+	var sum int
+	for _, n := range lengths {
+		sum += n
+	}
+	fmt.Fprintf(w, "hash-stats: buckets=%d max=%d mean=%.3f p99=%d\n",
+		len(lengths),
+		lengths[len(lengths)-1],
+		float64(sum)/float64(len(lengths)),
+		lengths[len(lengths)*99/100])
+}
+
+func (t *chunkTable) result() measurements {
+	if opt.hashStats {
+		t.collectChainLengths()
+	}
+	res := make(measurements, len(t.ids))
+	for idx, id := range t.ids {
+		res.mergeOne(displayID(id), &t.ms[idx])
+	}
+	return res
+}
+
+// processChunk aggregates rows in data[start:end], which must both be row
+// boundaries.
+func processChunk(data []byte, start, end int) measurements {
+	t := newChunkTable()
+
+	for i := start; i < end; {
+		if limitReached() {
+			break
+		}
+		idStart := i
+		hash := uint64(offset64)
+		for data[i] != ';' {
+			hash ^= uint64(data[i])
+			hash *= prime64
+			i++
+		}
+		id := data[idStart:i]
+		i++
+
+		if data[i] == '\n' { // empty temperature field: no reading
+			i++
+			continue
+		}
+		var v int64
+		if i+8 <= len(data) {
+			if opt.debug {
+				assertOverlap(i, end)
+			}
+			value, n := parseNumberWord(loadNumberWord(data[i:]))
+			v = value
+			i += n
+			if opt.stripSuffix {
+				// n assumed a newline right after the number;
+				// skip unit bytes up to the actual newline.
+				i--
+				for data[i] != '\n' {
+					i++
+				}
+				i++
+			}
+		} else {
+			j := i
+			for j < len(data) && data[j] != '\n' {
+				j++
+			}
+			v = parseTemp(data[i:j])
+			i = j + 1
+		}
+
+		t.record(id, hash, v)
+	}
+
+	return t.result()
+}
+
+// processChunkSorted is the -sorted-input specialization of processChunk.
+// Rows sorted by station id arrive as contiguous runs, so comparing
+// against the previous row's id replaces the hash table lookup for all
+// but the first row of each run, and completed runs flush straight into
+// the result map. Chunk boundaries split a run in two at most once per
+// chunk; the regular cross-chunk merge stitches those back together.
+func processChunkSorted(data []byte, start, end int) measurements {
+	res := measurements{}
+	var runID []byte
+	var run *measurement
+	flush := func() {
+		if run == nil {
+			return
+		}
+		if excludeSet != nil && isExcluded(runID, fnvHash(runID)) {
+			return
+		}
+		res.mergeOne(displayID(runID), run)
+	}
+
+	for i := start; i < end; {
+		if limitReached() {
+			break
+		}
+		idStart := i
+		for data[i] != ';' {
+			i++
+		}
+		id := data[idStart:i]
+		i++
+
+		if data[i] == '\n' { // empty temperature field: no reading
+			i++
+			continue
+		}
+		var v int64
+		if i+8 <= len(data) {
+			if opt.debug {
+				assertOverlap(i, end)
+			}
+			value, n := parseNumberWord(loadNumberWord(data[i:]))
+			v = value
+			i += n
+			if opt.stripSuffix {
+				i--
+				for data[i] != '\n' {
+					i++
+				}
+				i++
+			}
+		} else {
+			j := i
+			for j < len(data) && data[j] != '\n' {
+				j++
+			}
+			v = parseTemp(data[i:j])
+			i = j + 1
+		}
+
+		v = adjustTenths(v)
+		if run != nil && bytes.Equal(id, runID) {
+			run.add(v)
+			continue
+		}
+		flush()
+		runID = id
+		run = newMeasurement(v)
+	}
+	flush()
+
+	return res
+}
+
+// processChunkTempFirst is processChunk with the row fields swapped for
+// `-order temp-first` rows like `12.3;London`. The fast number parser
+// runs from offset 0 of the row; it stops at the byte after the last
+// digit whether that is '\n' or ';', so it needs no changes. The id scan
+// then runs to end of line.
+func processChunkTempFirst(data []byte, start, end int) measurements {
+	t := newChunkTable()
+
+	for i := start; i < end; {
+		if limitReached() {
+			break
+		}
+		if data[i] == ';' { // empty temperature field: no reading
+			for data[i] != '\n' {
+				i++
+			}
+			i++
+			continue
+		}
+		var v int64
+		if i+8 <= len(data) {
+			if opt.debug {
+				assertOverlap(i, end)
+			}
+			value, n := parseNumberWord(loadNumberWord(data[i:]))
+			v = value
+			i += n
+			if opt.stripSuffix {
+				// n assumed a ';' right after the number; skip unit
+				// bytes up to the actual field separator.
+				i--
+				for data[i] != ';' {
+					i++
+				}
+				i++
+			}
+		} else {
+			j := i
+			for j < len(data) && data[j] != ';' {
+				j++
+			}
+			v = parseTemp(data[i:j])
+			i = j + 1
+		}
+
+		idStart := i
+		hash := uint64(offset64)
+		for i < len(data) && data[i] != '\n' {
+			hash ^= uint64(data[i])
+			hash *= prime64
+			i++
+		}
+		id := data[idStart:i]
+		i++
+
+		t.record(id, hash, v)
+	}
+
+	return t.result()
+}
+
+// semicolonMask has the high bit of each ';' byte in word set, using the
+// strlen-style SWAR zero-byte detection on word^';'....
+func semicolonMask(word uint64) uint64 {
+	const semicolons = 0x3b3b3b3b3b3b3b3b
+	x := word ^ semicolons
+	return (x - 0x0101010101010101) &^ x & 0x8080808080808080
+}
+
+// processChunkSWAR is processChunk with an 8-byte-at-a-time id scan,
+// selected by -swar-ids. Long ids avoid the per-byte loop: each word is
+// folded into a multiply-xor hash and the final partial word is masked
+// up to the ';' located by semicolonMask. Collisions are still resolved
+// by comparing the full id in the table, so only the hash distribution
+// assumption carries over from FNV-1a.
+func processChunkSWAR(data []byte, start, end int) measurements {
+	t := newChunkTable()
+
+	for i := start; i < end; {
+		if limitReached() {
+			break
+		}
+		idStart := i
+		hash := uint64(offset64)
+		for {
+			if i+8 > len(data) {
+				// Near EOF: assemble the final words a byte at a time
+				// so the hash matches the word-wise scan.
+				var word uint64
+				n := 0
+				for n < 8 && data[i+n] != ';' {
+					word |= uint64(data[i+n]) << (8 * n)
+					n++
+				}
+				hash = (hash ^ word) * prime64
+				i += n
+				if n == 8 {
+					continue
+				}
+				break
+			}
+			word := binary.LittleEndian.Uint64(data[i:])
+			if m := semicolonMask(word); m != 0 {
+				n := bits.TrailingZeros64(m) >> 3
+				hash = (hash ^ (word & (1<<(8*uint(n)) - 1))) * prime64
+				i += n
+				break
+			}
+			hash = (hash ^ word) * prime64
+			i += 8
+		}
+		id := data[idStart:i]
+		i++
+		// Multiplication mod 2^64 never carries high bits downward, so
+		// ids differing only in the upper bytes of a word would share
+		// the low bits used as the bucket index; fold them in.
+		hash ^= hash >> 33
+
+		if data[i] == '\n' { // empty temperature field: no reading
+			i++
+			continue
+		}
+		var v int64
+		if i+8 <= len(data) {
+			if opt.debug {
+				assertOverlap(i, end)
+			}
+			value, n := parseNumberWord(loadNumberWord(data[i:]))
+			v = value
+			i += n
+			if opt.stripSuffix {
+				// n assumed a newline right after the number;
+				// skip unit bytes up to the actual newline.
+				i--
+				for data[i] != '\n' {
+					i++
+				}
+				i++
+			}
+		} else {
+			j := i
+			for j < len(data) && data[j] != '\n' {
+				j++
+			}
+			v = parseTemp(data[i:j])
+			i = j + 1
+		}
+
+		t.record(id, hash, v)
+	}
+
+	return t.result()
+}
+
+// processChunkStrict is the validating variant for untrusted data: the
+// fast path assumes valid input and silently produces garbage on
+// malformed rows, so -strict checks every row against
+// `^[^;]+;-?[0-9]{1,2}\.[0-9]$` and aborts with the offending line on
+// the first violation. Validation costs several times the fused loop.
+func processChunkStrict(data []byte, start, end int) measurements {
+	res := measurements{}
+	for i := start; i < end; {
+		if limitReached() {
+			break
+		}
+		nl := bytes.IndexByte(data[i:end], '\n')
+		row := data[i : i+nl]
+		i += nl + 1
+
+		id, temp, ok := validRow(row)
+		if !ok {
+			log.Fatalf("invalid row %q", row)
+		}
+		if excludeSet != nil && isExcluded(id, fnvHash(id)) {
+			continue
+		}
+		res.record(displayID(id), parseNumber(temp))
+	}
+	return res
+}
+
+// validRow checks row against the grammar and splits it into id and
+// temperature.
+func validRow(row []byte) (id, temp []byte, ok bool) {
+	sep := bytes.IndexByte(row, ';')
+	if sep < 1 {
+		return nil, nil, false
+	}
+	id, temp = row[:sep], row[sep+1:]
+
+	t := temp
+	if len(t) > 0 && t[0] == '-' {
+		t = t[1:]
+	}
+	if len(t) == 4 {
+		if t[0] < '0' || t[0] > '9' {
+			return nil, nil, false
+		}
+		t = t[1:]
+	}
+	if len(t) != 3 || t[0] < '0' || t[0] > '9' || t[1] != '.' || t[2] < '0' || t[2] > '9' {
+		return nil, nil, false
+	}
+	return id, temp, true
+}
+
+// sepTable marks the -auto-sep separator bytes; nil keeps the single
+// ';' fast path.
+var sepTable *[256]bool
+
+func buildSepTable(seps string) *[256]bool {
+	var t [256]bool
+	for i := 0; i < len(seps); i++ {
+		t[seps[i]] = true
+	}
+	return &t
+}
+
+// processChunkScalar is the slower variant of processChunk used by modes
+// the fused loop cannot express. With -quoted-ids a double-quoted id may
+// contain ';' and escapes inner quotes by doubling them; newlines inside
+// quotes are not supported as chunks split on '\n'. With -timestamps each
+// row carries a trailing timestamp field.
+func processChunkScalar(data []byte, start, end int) measurements {
+	res := measurements{}
+	for i := start; i < end; {
+		if limitReached() {
+			break
+		}
+		var id []byte
+		switch {
+		case opt.quotedIds && data[i] == '"':
+			id, i = parseQuotedID(data, i)
+			if i >= end || data[i] != ';' {
+				log.Fatalf("missing ';' after id %q", id)
+			}
+		case sepTable != nil:
+			// -auto-sep: the id ends at the first byte in the set.
+			j := i
+			for j < end && !sepTable[data[j]] && data[j] != '\n' {
+				j++
+			}
+			if j >= end || data[j] == '\n' {
+				log.Fatalf("invalid row %q", data[i:j])
+			}
+			id = data[i:j]
+			i = j
+		default:
+			sep := bytes.IndexByte(data[i:end], ';')
+			if sep == -1 {
+				log.Fatalf("invalid row %q", data[i:end])
+			}
+			id = data[i : i+sep]
+			i += sep
+		}
+		i++
+		j := i
+		for j < end && data[j] != '\n' {
+			j++
+		}
+		recordRest(res, displayID(id), data[i:j])
+		i = j + 1
+	}
+	return res
+}
+
+// recordRest aggregates the row remainder after the id separator: an
+// optional -sign-token field, the temperature, under -timestamps followed
+// by `;<timestamp>`.
+func recordRest(res measurements, id, rest []byte) {
+	if excludeSet != nil && isExcluded(id, fnvHash(id)) {
+		return
+	}
+	negative := false
+	if opt.signToken != "" {
+		sep := bytes.IndexByte(rest, ';')
+		if sep == -1 {
+			log.Fatalf("missing sign field in row for %q", id)
+		}
+		negative = string(rest[:sep]) == opt.signToken
+		rest = rest[sep+1:]
+	}
+	if opt.extraFields > 0 {
+		if sep := bytes.IndexByte(rest, ';'); sep != -1 {
+			rest = rest[:sep]
+		}
+	}
+	temp := rest
+	var ts []byte
+	if opt.timestamps {
+		sep := bytes.IndexByte(rest, ';')
+		if sep == -1 {
+			log.Fatalf("missing timestamp in row for %q", id)
+		}
+		temp, ts = rest[:sep], rest[sep+1:]
+	}
+	weight := int64(1)
+	if opt.weighted {
+		sep := bytes.IndexByte(rest, ';')
+		if sep == -1 {
+			log.Fatalf("missing weight in row for %q", id)
+		}
+		temp = rest[:sep]
+		w, err := strconv.ParseInt(string(rest[sep+1:]), 10, 64)
+		if err != nil {
+			log.Fatalf("invalid weight in row for %q: %v", id, err)
+		}
+		weight = w
+	}
+	if missingTemp(temp) {
+		return
+	}
+	v := parseTemp(temp)
+	if negative {
+		v = -v
+	}
+	switch {
+	case opt.timestamps:
+		res.recordAt(id, v, ts)
+	case opt.weighted:
+		res.recordWeighted(id, v, weight)
+	default:
+		res.record(id, v)
+	}
+}
+
+// missingTemp reports whether the temperature field denotes a missing
+// reading: an empty field or the -null-value sentinel.
+func missingTemp(temp []byte) bool {
+	return len(temp) == 0 || (opt.nullValue != "" && string(temp) == opt.nullValue)
+}
+
+// parseTemp parses a temperature into tenths on the scalar path.
+func parseTemp(b []byte) int64 {
+	if opt.stripSuffix {
+		end := len(b)
+		for end > 0 && (b[end-1] < '0' || b[end-1] > '9') {
+			end--
+		}
+		b = b[:end]
+	}
+	if opt.scientific {
+		v, err := strconv.ParseFloat(string(b), 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return int64(math.Round(v * 10))
+	}
+	return parseNumber(b)
+}
+
+// parseQuotedID returns the id starting with a double quote at data[i],
+// with the surrounding quotes stripped and doubled inner quotes collapsed,
+// and the position after the closing quote.
+func parseQuotedID(data []byte, i int) ([]byte, int) {
+	i++ // opening quote
+	start := i
+	var unescaped []byte
+	for {
+		j := bytes.IndexByte(data[i:], '"')
+		if j == -1 {
+			log.Fatalf("unterminated quoted id %q", data[start:])
+		}
+		i += j
+		if i+1 < len(data) && data[i+1] == '"' {
+			unescaped = append(unescaped, data[start:i+1]...)
+			i += 2
+			start = i
+			continue
+		}
+		if unescaped == nil {
+			return data[start:i], i + 1
+		}
+		return append(unescaped, data[start:i]...), i + 1
+	}
+}
+
+// parseRow aggregates a single `<station>;<temperature>` row with an
+// optional trailing newline.
+func parseRow(row []byte, res measurements) {
+	row = bytes.TrimSuffix(row, []byte{'\n'})
+	if opt.strict {
+		if _, _, ok := validRow(row); !ok {
+			log.Fatalf("invalid row %q", row)
+		}
+	}
+	var id, temp []byte
+	if opt.quotedIds && len(row) > 0 && row[0] == '"' {
+		var next int
+		id, next = parseQuotedID(row, 0)
+		if next >= len(row) || row[next] != ';' {
+			log.Fatalf("invalid row %q", row)
+		}
+		temp = row[next+1:]
+	} else {
+		sep := -1
+		if sepTable != nil {
+			for k, c := range row {
+				if sepTable[c] {
+					sep = k
+					break
+				}
+			}
+		} else {
+			sep = bytes.IndexByte(row, ';')
+		}
+		if sep == -1 {
+			log.Fatalf("invalid row %q", row)
+		}
+		id, temp = row[:sep], row[sep+1:]
+		if opt.order == "temp-first" {
+			id, temp = temp, id
+		}
+	}
+	recordRest(res, displayID(id), temp)
+}
+
+// parseNumber parses a temperature into tenths, e.g. "-12.3" into -123.
+func parseNumber(b []byte) int64 {
+	neg := len(b) > 0 && b[0] == '-'
+	if neg {
+		b = b[1:]
+	} else if opt.unicodeMinus && len(b) >= 3 && b[0] == 0xe2 && b[1] == 0x88 && b[2] == 0x92 {
+		// U+2212 MINUS SIGN, as some exports write it. Its byte layout
+		// breaks the branchless word parser, which is why -unicode-minus
+		// routes rows through this scalar path.
+		neg = true
+		b = b[3:]
+	}
+	var v int64
+	for _, c := range b {
+		if c == '.' {
+			continue
+		}
+		v = v*10 + int64(c-'0')
+	}
+	if neg {
+		return -v
+	}
+	return v
+}
+
+// parseNumberLE parses a temperature in tenths from the little-endian word
+// of the next 8 input bytes and returns the number of bytes consumed
+// including the trailing newline. The branchless conversion locates the
+// decimal dot via the 0x10 bit, which is set in digit bytes and clear in
+// '.' and '-'. The word is decoded with an explicit byte order, so the
+// masks are correct regardless of host endianness; big-endian targets load
+// natively and byte-swap, see parseNumberBE.
+func parseNumberLE(word uint64) (int64, int) {
+	if false {
+		// debug: dump the word next to its input bytes
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, word)
+		fmt.Printf("parseNumberLE %#016x %q\n", word, b)
+	}
+	decimalSepPos := bits.TrailingZeros64(^word & 0x10101000)
+	signed := int64(^word<<59) >> 63
+	designMask := uint64(^(signed & 0xff))
+	digits := ((word & designMask) << (28 - decimalSepPos)) & 0x0f000f0f00
+	absValue := int64((digits * 0x640a0001) >> 32 & 0x3ff)
+	return (absValue ^ signed) - signed, decimalSepPos>>3 + 3
+}
+
+// parseNumberBE is parseNumberLE for a natively loaded big-endian word.
+func parseNumberBE(word uint64) (int64, int) {
+	return parseNumberLE(bits.ReverseBytes64(word))
+}
+
+// roundJava rounds like java.lang.Math.round: half up towards positive
+// infinity.
+func roundJava(x float64) float64 {
+	return math.Floor(x + 0.5)
+}
+
+// writeReservoirs dumps the -reservoir samples, one
+// `station;reading;...` line per station sorted by id, for downstream
+// distribution fitting.
+func writeReservoirs(res measurements, path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	ids := make([]string, 0, len(res))
+	for id := range res {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	w := bufio.NewWriter(f)
+	defer w.Flush()
+	for _, id := range ids {
+		m := res[id]
+		if m.sample == nil {
+			continue
+		}
+		w.WriteString(id)
+		for _, v := range m.sample.vals {
+			fmt.Fprintf(w, ";%.1f", float64(v)/10)
+		}
+		w.WriteByte('\n')
+	}
+}
+
+func printResult(res measurements, output io.Writer) {
+	// The default brace format already matches the reference Java output
+	// byte for byte: roundJava rounds the mean half up towards positive
+	// infinity like java.lang.Math.round, and no field ever prints as
+	// -0.0 since temperatures are integer tenths and floor(x+0.5) never
+	// yields negative zero. -java-compat pins that layout against the
+	// other output flags.
+	format := opt.format
+	if opt.javaCompat {
+		format = "brace"
+	}
+	printResultAs(res, output, format)
+}
+
+func printResultAs(res measurements, output io.Writer, format string) {
+	ids := make([]string, 0, len(res))
+	for id := range res {
+		ids = append(ids, id)
+	}
+	if opt.orderFile != "" && !opt.javaCompat {
+		ids = orderIds(ids, opt.orderFile)
+	} else if !opt.noSort || opt.javaCompat {
+		if opt.extSort > 0 && len(ids) > opt.extSort {
+			ids = externalSort(ids, opt.extSort)
+		} else {
+			sort.Strings(ids)
+		}
+	}
+
+	if opt.outputEncoding == "latin1" {
+		// Render to memory first: transcoding a complete buffer avoids
+		// dealing with UTF-8 sequences split across writes.
+		var buf bytes.Buffer
+		bw := bufio.NewWriter(&buf)
+		formats[format](bw, ids, res)
+		bw.Flush()
+		encoded, replaced := encodeLatin1(buf.Bytes())
+		if replaced > 0 {
+			log.Printf("output-encoding latin1: replaced %d unmappable characters with '?'", replaced)
+		}
+		output.Write(encoded)
+		return
+	}
+	w := bufio.NewWriter(output)
+	defer w.Flush()
+	formats[format](w, ids, res)
+}
+
+// encodeLatin1 transcodes UTF-8 to ISO 8859-1, whose code points are
+// exactly the first 256 of Unicode. Characters beyond U+00FF have no
+// Latin-1 form and become '?'; the count is reported so a silent lossy
+// run does not go unnoticed. Hand-rolled to keep the binary free of an
+// encoding dependency, like the sqlite dump.
+func encodeLatin1(b []byte) ([]byte, int) {
+	out := make([]byte, 0, len(b))
+	replaced := 0
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+		if r <= 0xff && (r != utf8.RuneError || size == 1 && b[i] < 0x80) {
+			out = append(out, byte(r))
+		} else {
+			out = append(out, '?')
+			replaced++
+		}
+		i += size
+	}
+	return out, replaced
+}
+
+// externalSort sorts station ids with bounded memory for extreme
+// cardinality: runs of at most runSize ids sort in memory and spill to
+// temp files, one id per line (the grammar forbids newlines in ids), and
+// a k-way merge of the runs reassembles the full order. The result is
+// byte-identical to sort.Strings.
+func externalSort(ids []string, runSize int) []string {
+	var runs []*bufio.Scanner
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	for start := 0; start < len(ids); start += runSize {
+		run := ids[start:min(start+runSize, len(ids))]
+		sort.Strings(run)
+		f, err := os.CreateTemp("", "extsort-*")
+		if err != nil {
+			log.Fatal(err)
+		}
+		files = append(files, f)
+		w := bufio.NewWriter(f)
+		for _, id := range run {
+			w.WriteString(id)
+			w.WriteByte('\n')
+		}
+		if err := w.Flush(); err != nil {
+			log.Fatal(err)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			log.Fatal(err)
+		}
+		runs = append(runs, bufio.NewScanner(f))
+	}
+
+	// The run count is small (ids/runSize), so a linear scan for the
+	// minimum head beats the bookkeeping of a heap.
+	heads := make([]string, len(runs))
+	alive := make([]bool, len(runs))
+	for i, r := range runs {
+		if r.Scan() {
+			heads[i], alive[i] = r.Text(), true
+		}
+	}
+	sorted := ids[:0]
+	for {
+		best := -1
+		for i, ok := range alive {
+			if ok && (best == -1 || heads[i] < heads[best]) {
+				best = i
+			}
+		}
+		if best == -1 {
+			return sorted
+		}
+		sorted = append(sorted, heads[best])
+		if runs[best].Scan() {
+			heads[best] = runs[best].Text()
+		} else {
+			alive[best] = false
+		}
+	}
+}
+
+// formats registers every output format by name; new formatters added
+// here show up in -list-formats and in the unknown-format error.
+var formats = map[string]func(w *bufio.Writer, ids []string, res measurements){
+	"brace":    printBrace,
+	"json":     printJSON,
+	"csv":      printCSV,
+	"go":       printGo,
+	"ndjson":   printNDJSON,
+	"table":    printTable,
+	"sqlite":   printSQLite,
+	"dense":    printDense,
+	"protobuf": printProtobuf,
+	"parquet":  printParquet,
+}
+
+// printDense emits one line of means in -order-file order, a feature
+// vector for pipelines with a fixed station set. Unlike the other
+// formats it walks the order file itself, so listed stations absent
+// from the data still occupy their slot, filled with -fill.
+func printDense(w *bufio.Writer, ids []string, res measurements) {
+	if opt.orderFile == "" {
+		log.Fatalf("-format dense requires -order-file to fix the vector layout")
+	}
+	data, err := os.ReadFile(opt.orderFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	first := true
+	for _, id := range strings.Split(string(data), "\n") {
+		if id == "" {
+			continue
+		}
+		if !first {
+			w.WriteByte(',')
+		}
+		first = false
+		if m := res[id]; m != nil {
+			w.WriteString(meanString(m))
+		} else {
+			w.WriteString(opt.fill)
+		}
+	}
+	w.WriteByte('\n')
+}
+
+func formatNames() []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// orderIds arranges ids following the -order-file listing: listed
+// stations first in file order, the rest sorted at the end unless
+// -omit-unlisted drops them. Listed stations absent from the result are
+// skipped.
+func orderIds(ids []string, path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	present := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		present[id] = true
+	}
+
+	out := make([]string, 0, len(ids))
+	for _, id := range strings.Split(string(data), "\n") {
+		if id != "" && present[id] {
+			out = append(out, id)
+			delete(present, id)
+		}
+	}
+	if !opt.omitUnlisted {
+		rest := make([]string, 0, len(present))
+		for id := range present {
+			rest = append(rest, id)
+		}
+		sort.Strings(rest)
+		out = append(out, rest...)
+	}
+	return out
+}
+
+// meanString formats a station's mean per -mean-mode. The default
+// reproduces the challenge's semantics: round the aggregated sum/count
+// to one decimal, which is not the same as averaging pre-rounded rows.
+func meanString(m *measurement) string {
+	mean := float64(m.sum) / float64(m.count)
+	switch opt.meanMode {
+	case "exact":
+		return strconv.FormatFloat(mean/10, 'f', -1, 64)
+	case "highprec":
+		return strconv.FormatFloat(mean/10, 'f', 6, 64)
+	default:
+		return strconv.FormatFloat(roundJava(mean)/10, 'f', 1, 64)
+	}
+}
+
+// onlyStat formats the single statistic selected by -only.
+func onlyStat(m *measurement) string {
+	switch opt.only {
+	case "min":
+		return strconv.FormatFloat(float64(m.min)/10, 'f', 1, 64)
+	case "mean":
+		return meanString(m)
+	case "max":
+		return strconv.FormatFloat(float64(m.max)/10, 'f', 1, 64)
+	default:
+		return strconv.FormatInt(m.count, 10)
+	}
+}
+
+func printBrace(w *bufio.Writer, ids []string, res measurements) {
+	sep := ", "
+	if opt.compact {
+		sep = ","
+	}
+	w.WriteByte('{')
+	for i, id := range ids {
+		if i > 0 {
+			w.WriteString(sep)
+		}
+		braceEntry(w, id, res[id])
+	}
+	w.WriteString("}\n")
+}
+
+// braceEntry writes one station's `id=...` brace-format entry; shared
+// by printBrace and the -stream path.
+func braceEntry(w *bufio.Writer, id string, m *measurement) {
+	if opt.only != "" {
+		fmt.Fprintf(w, "%s=%s", id, onlyStat(m))
+		return
+	}
+	if opt.timestamps {
+		fmt.Fprintf(w, "%s=%.1f@%s/%s/%.1f@%s", id,
+			float64(m.min)/10, m.minAt,
+			meanString(m),
+			float64(m.max)/10, m.maxAt)
+	} else if opt.minmaxRows {
+		fmt.Fprintf(w, "%s=%.1f#%d/%s/%.1f#%d", id,
+			float64(m.min)/10, m.minRow,
+			meanString(m),
+			float64(m.max)/10, m.maxRow)
+	} else {
+		fmt.Fprintf(w, "%s=%.1f/%s/%.1f", id,
+			float64(m.min)/10,
+			meanString(m),
+			float64(m.max)/10)
+	}
+	if opt.withCount {
+		fmt.Fprintf(w, "/%d", m.count)
+	}
+	if m.values != nil {
+		fmt.Fprintf(w, "/%d", m.values.distinct())
+	}
+}
+
+// streamSorted prints each station the moment its run of rows ends:
+// with the input sorted by id a station is final once the next id
+// differs, so no result map accumulates and output memory stays O(1)
+// regardless of cardinality. The scan is single-threaded; the parallel
+// chunk merge cannot tell when a station is complete. Only valid under
+// -sorted-input, which also keeps the brace output sorted.
+func streamSorted(data []byte, output io.Writer) {
+	w := bufio.NewWriter(output)
+	defer w.Flush()
+	sep := ", "
+	if opt.compact {
+		sep = ","
+	}
+	w.WriteByte('{')
+	first := true
+	var runID []byte
+	var run *measurement
+	flush := func() {
+		if run == nil {
+			return
+		}
+		if excludeSet != nil && isExcluded(runID, fnvHash(runID)) {
+			return
+		}
+		if !first {
+			w.WriteString(sep)
+		}
+		first = false
+		braceEntry(w, string(displayID(runID)), run)
+	}
+
+	for i := 0; i < len(data); {
+		var row []byte
+		if nl := bytes.IndexByte(data[i:], '\n'); nl == -1 {
+			row, i = data[i:], len(data)
+		} else {
+			row, i = data[i:i+nl], i+nl+1
+		}
+		if len(row) == 0 {
+			continue
+		}
+		sep := bytes.IndexByte(row, ';')
+		if sep == -1 {
+			log.Fatalf("invalid row %q", row)
+		}
+		id, temp := row[:sep], row[sep+1:]
+		if missingTemp(temp) {
+			continue
+		}
+		v := adjustTenths(parseTemp(temp))
+		if run != nil && bytes.Equal(id, runID) {
+			run.add(v)
+			continue
+		}
+		flush()
+		runID = append(runID[:0], id...)
+		run = newMeasurement(v)
+	}
+	flush()
+	w.WriteString("}\n")
+}
+
+// printJSON emits one object per station. The default fields follow the
+// output rounding rules, which makes the file lossy: a mean rounded to
+// one decimal cannot be combined with another shard's mean without
+// error. With -raw-tenths the exact integer tenths are written instead,
+// including the sum, and -merge re-aggregates such shards losslessly.
+func printJSON(w *bufio.Writer, ids []string, res measurements) {
+	w.WriteByte('{')
+	for i, id := range ids {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		m := res[id]
+		key, _ := json.Marshal(id)
+		if opt.only != "" {
+			fmt.Fprintf(w, "%s:%s", key, onlyStat(m))
+			continue
+		}
+		if opt.rawTenths {
+			fmt.Fprintf(w, `%s:{"min":%d,"max":%d,"sum":%d,"count":%d}`,
+				key, m.min, m.max, m.sum, m.count)
+			continue
+		}
+		fmt.Fprintf(w, `%s:{"min":%.1f,"mean":%s,"max":%.1f,"count":%d}`,
+			key,
+			float64(m.min)/10,
+			meanString(m),
+			float64(m.max)/10,
+			m.count)
+	}
+	w.WriteString("}\n")
+}
+
+// outputColumns is the parsed -columns selection; nil means each
+// format's full default layout. Set in main and by tests.
+var outputColumns []string
+
+// parseColumns validates a -columns list like "station,max,min,count".
+func parseColumns(s string) []string {
+	cols := strings.Split(s, ",")
+	for i, c := range cols {
+		c = strings.TrimSpace(c)
+		switch c {
+		case "station", "min", "mean", "max", "count":
+		default:
+			log.Fatalf("unknown -columns field %q, supported: station, min, mean, max, count", c)
+		}
+		cols[i] = c
+	}
+	return cols
+}
+
+// columnCell formats one -columns field of a station row. The station
+// column is returned raw; formats that quote it handle that themselves.
+func columnCell(col, id string, m *measurement) string {
+	switch col {
+	case "station":
+		return id
+	case "min":
+		return strconv.FormatFloat(float64(m.min)/10, 'f', 1, 64)
+	case "mean":
+		return meanString(m)
+	case "max":
+		return strconv.FormatFloat(float64(m.max)/10, 'f', 1, 64)
+	default: // count
+		return strconv.FormatInt(m.count, 10)
+	}
+}
+
+// printNDJSON emits newline-delimited JSON, one object per station, for
+// line-by-line consumers like jq and log processors. Rounding follows
+// the json format.
+func printNDJSON(w *bufio.Writer, ids []string, res measurements) {
+	if outputColumns != nil {
+		for _, id := range ids {
+			m := res[id]
+			w.WriteByte('{')
+			for i, col := range outputColumns {
+				if i > 0 {
+					w.WriteByte(',')
+				}
+				if col == "station" {
+					key, _ := json.Marshal(id)
+					fmt.Fprintf(w, `"station":%s`, key)
+				} else {
+					fmt.Fprintf(w, `"%s":%s`, col, columnCell(col, id, m))
+				}
+			}
+			w.WriteString("}\n")
+		}
+		return
+	}
+	for _, id := range ids {
+		m := res[id]
+		key, _ := json.Marshal(id)
+		fmt.Fprintf(w, `{"station":%s,"min":%.1f,"mean":%s,"max":%.1f,"count":%d}`+"\n",
+			key,
+			float64(m.min)/10,
+			meanString(m),
+			float64(m.max)/10,
+			m.count)
+	}
+}
+
+// printGo emits the result as a Go map literal for pasting into test
+// fixtures. The fields are the exact int64 tenths, not rounded floats,
+// so fixtures are lossless.
+func printGo(w *bufio.Writer, ids []string, res measurements) {
+	w.WriteString("map[string]measurement{\n")
+	for _, id := range ids {
+		m := res[id]
+		fmt.Fprintf(w, "\t%q: {min: %d, max: %d, sum: %d, count: %d},\n",
+			id, m.min, m.max, m.sum, m.count)
+	}
+	w.WriteString("}\n")
+}
+
+func printCSV(w *bufio.Writer, ids []string, res measurements) {
+	cw := csv.NewWriter(w)
+	if outputColumns != nil {
+		cw.Write(outputColumns)
+		row := make([]string, len(outputColumns))
+		for _, id := range ids {
+			for i, col := range outputColumns {
+				row[i] = columnCell(col, id, res[id])
+			}
+			cw.Write(row)
+		}
+		cw.Flush()
+		return
+	}
+	if opt.only != "" {
+		cw.Write([]string{"station", opt.only})
+		for _, id := range ids {
+			cw.Write([]string{id, onlyStat(res[id])})
+		}
+		cw.Flush()
+		return
+	}
+	cw.Write([]string{"station", "min", "mean", "max", "count"})
+	for _, id := range ids {
+		m := res[id]
+		cw.Write([]string{
+			id,
+			strconv.FormatFloat(float64(m.min)/10, 'f', 1, 64),
+			meanString(m),
+			strconv.FormatFloat(float64(m.max)/10, 'f', 1, 64),
+			strconv.FormatInt(m.count, 10),
+		})
+	}
+	cw.Flush()
+}
+
+// printTable emits a fixed-width aligned report for reading in a
+// terminal. Numbers are right-aligned and column widths adapt to the
+// longest cell, so arbitrarily long station names stay aligned.
+func printTable(w *bufio.Writer, ids []string, res measurements) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	if outputColumns != nil {
+		for _, col := range outputColumns {
+			fmt.Fprintf(tw, "%s\t", strings.ToUpper(col[:1])+col[1:])
+		}
+		tw.Write([]byte{'\n'})
+		for _, id := range ids {
+			for _, col := range outputColumns {
+				fmt.Fprintf(tw, "%s\t", columnCell(col, id, res[id]))
+			}
+			tw.Write([]byte{'\n'})
+		}
+		tw.Flush()
+		return
+	}
+	fmt.Fprintf(tw, "Station\tMin\tMean\tMax\tCount\t\n")
+	for _, id := range ids {
+		m := res[id]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t\n",
+			id,
+			strconv.FormatFloat(float64(m.min)/10, 'f', 1, 64),
+			meanString(m),
+			strconv.FormatFloat(float64(m.max)/10, 'f', 1, 64),
+			m.count)
+	}
+	tw.Flush()
+}
+
+// printSQLite emits a SQL dump for the sqlite3 CLI, e.g.
+// `calc -format sqlite measurements.txt | sqlite3 out.db`. A dump keeps
+// the binary free of a database driver while still loading 400k stations
+// quickly: all inserts run in one transaction, batched 500 rows per
+// statement. -raw-tenths swaps the rounded REAL columns for the exact
+// integer tenths so nothing is lost to rounding.
+func printSQLite(w *bufio.Writer, ids []string, res measurements) {
+	const batch = 500
+	if opt.rawTenths {
+		w.WriteString("CREATE TABLE IF NOT EXISTS measurements (station TEXT PRIMARY KEY, min INTEGER, max INTEGER, sum INTEGER, count INTEGER);\n")
+	} else {
+		w.WriteString("CREATE TABLE IF NOT EXISTS measurements (station TEXT PRIMARY KEY, min REAL, mean REAL, max REAL, count INTEGER);\n")
+	}
+	w.WriteString("BEGIN;\n")
+	for i, id := range ids {
+		if i%batch == 0 {
+			if i > 0 {
+				w.WriteString(";\n")
+			}
+			w.WriteString("INSERT INTO measurements VALUES\n")
+		} else {
+			w.WriteString(",\n")
+		}
+		m := res[id]
+		quoted := strings.ReplaceAll(id, "'", "''")
+		if opt.rawTenths {
+			fmt.Fprintf(w, "('%s',%d,%d,%d,%d)", quoted, m.min, m.max, m.sum, m.count)
+			continue
+		}
+		fmt.Fprintf(w, "('%s',%.1f,%s,%.1f,%d)",
+			quoted,
+			float64(m.min)/10,
+			meanString(m),
+			float64(m.max)/10,
+			m.count)
+	}
+	if len(ids) > 0 {
+		w.WriteString(";\n")
+	}
+	w.WriteString("COMMIT;\n")
+}
+
+// printParquet emits a Parquet file, e.g. `-format parquet -o out.parquet`:
+// one row group with five required columns (station, min, mean, max,
+// count), PLAIN-encoded and uncompressed, followed by the
+// thrift-compact footer. Like the sqlite and protobuf writers the
+// encoding is hand-rolled against the stable wire format, which keeps
+// the binary free of a Parquet library; required columns carry no
+// definition levels, so the pages are just the raw values.
+// -raw-tenths swaps the rounded doubles for the exact integer tenths
+// (min, max, sum), matching the sqlite layout.
+func printParquet(w *bufio.Writer, ids []string, res measurements) {
+	// Parquet physical types.
+	const (
+		typeInt64     = 2
+		typeDouble    = 5
+		typeByteArray = 6
+	)
+	type column struct {
+		name string
+		typ  int
+		data []byte
+	}
+	cols := []column{
+		{name: "station", typ: typeByteArray},
+		{name: "min", typ: typeDouble},
+		{name: "mean", typ: typeDouble},
+		{name: "max", typ: typeDouble},
+		{name: "count", typ: typeInt64},
+	}
+	if opt.rawTenths {
+		cols = []column{
+			{name: "station", typ: typeByteArray},
+			{name: "min", typ: typeInt64},
+			{name: "max", typ: typeInt64},
+			{name: "sum", typ: typeInt64},
+			{name: "count", typ: typeInt64},
+		}
+	}
+	appendDouble := func(b []byte, v float64) []byte {
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	}
+	for _, id := range ids {
+		m := res[id]
+		cols[0].data = binary.LittleEndian.AppendUint32(cols[0].data, uint32(len(id)))
+		cols[0].data = append(cols[0].data, id...)
+		if opt.rawTenths {
+			cols[1].data = binary.LittleEndian.AppendUint64(cols[1].data, uint64(m.min))
+			cols[2].data = binary.LittleEndian.AppendUint64(cols[2].data, uint64(m.max))
+			cols[3].data = binary.LittleEndian.AppendUint64(cols[3].data, uint64(m.sum))
+		} else {
+			cols[1].data = appendDouble(cols[1].data, float64(m.min)/10)
+			cols[2].data = appendDouble(cols[2].data, roundJava(float64(m.sum)/float64(m.count))/10)
+			cols[3].data = appendDouble(cols[3].data, float64(m.max)/10)
+		}
+		cols[4].data = binary.LittleEndian.AppendUint64(cols[4].data, uint64(m.count))
+	}
+
+	rows := len(ids)
+	file := []byte("PAR1")
+	offsets := make([]int64, len(cols))
+	sizes := make([]int64, len(cols))
+	for i, c := range cols {
+		offsets[i] = int64(len(file))
+		header := parquetPageHeader(rows, len(c.data))
+		file = append(file, header...)
+		file = append(file, c.data...)
+		sizes[i] = int64(len(header) + len(c.data))
+	}
+
+	// FileMetaData.
+	var meta []byte
+	meta = append(meta, 0x15) // 1: version, i32
+	meta = thriftVarint(meta, 1)
+	meta = append(meta, 0x19) // 2: schema, list<struct>
+	meta = thriftListHeader(meta, len(cols)+1, 0x0c)
+	// The root group element: name and child count only.
+	meta = append(meta, 0x48) // 4: name, string
+	meta = thriftString(meta, "schema")
+	meta = append(meta, 0x15) // 5: num_children, i32
+	meta = thriftVarint(meta, int64(len(cols)))
+	meta = append(meta, 0x00)
+	for _, c := range cols {
+		meta = append(meta, 0x15) // 1: type, i32
+		meta = thriftVarint(meta, int64(c.typ))
+		meta = append(meta, 0x25) // 3: repetition_type, i32: REQUIRED
+		meta = thriftVarint(meta, 0)
+		meta = append(meta, 0x18) // 4: name, string
+		meta = thriftString(meta, c.name)
+		if c.typ == typeByteArray {
+			meta = append(meta, 0x25) // 6: converted_type, i32: UTF8
+			meta = thriftVarint(meta, 0)
+		}
+		meta = append(meta, 0x00)
+	}
+	meta = append(meta, 0x16) // 3: num_rows, i64
+	meta = thriftVarint(meta, int64(rows))
+	meta = append(meta, 0x19) // 4: row_groups, list<struct>
+	meta = thriftListHeader(meta, 1, 0x0c)
+	meta = append(meta, 0x19) // 1: columns, list<struct>
+	meta = thriftListHeader(meta, len(cols), 0x0c)
+	var total int64
+	for i := range cols {
+		total += sizes[i]
+	}
+	for i, c := range cols {
+		meta = append(meta, 0x26) // 2: file_offset, i64
+		meta = thriftVarint(meta, offsets[i])
+		meta = append(meta, 0x1c) // 3: meta_data, struct
+		meta = append(meta, 0x15) // 1: type, i32
+		meta = thriftVarint(meta, int64(c.typ))
+		meta = append(meta, 0x19) // 2: encodings, list<i32>: PLAIN
+		meta = thriftListHeader(meta, 1, 0x05)
+		meta = thriftVarint(meta, 0)
+		meta = append(meta, 0x19) // 3: path_in_schema, list<string>
+		meta = thriftListHeader(meta, 1, 0x08)
+		meta = thriftString(meta, c.name)
+		meta = append(meta, 0x15) // 4: codec, i32: UNCOMPRESSED
+		meta = thriftVarint(meta, 0)
+		meta = append(meta, 0x16) // 5: num_values, i64
+		meta = thriftVarint(meta, int64(rows))
+		meta = append(meta, 0x16) // 6: total_uncompressed_size, i64
+		meta = thriftVarint(meta, sizes[i])
+		meta = append(meta, 0x16) // 7: total_compressed_size, i64
+		meta = thriftVarint(meta, sizes[i])
+		meta = append(meta, 0x26) // 9: data_page_offset, i64
+		meta = thriftVarint(meta, offsets[i])
+		meta = append(meta, 0x00)
+		meta = append(meta, 0x00)
+	}
+	meta = append(meta, 0x16) // 2: total_byte_size, i64
+	meta = thriftVarint(meta, total)
+	meta = append(meta, 0x16) // 3: num_rows, i64
+	meta = thriftVarint(meta, int64(rows))
+	meta = append(meta, 0x00)
+	meta = append(meta, 0x28) // 6: created_by, string
+	meta = thriftString(meta, "onebrc")
+	meta = append(meta, 0x00)
+
+	file = append(file, meta...)
+	file = binary.LittleEndian.AppendUint32(file, uint32(len(meta)))
+	file = append(file, "PAR1"...)
+	w.Write(file)
+}
+
+// parquetPageHeader encodes the v1 data page header for one column: n
+// PLAIN values in size bytes, uncompressed.
+func parquetPageHeader(n, size int) []byte {
+	var b []byte
+	b = append(b, 0x15) // 1: type, i32: DATA_PAGE
+	b = thriftVarint(b, 0)
+	b = append(b, 0x15) // 2: uncompressed_page_size, i32
+	b = thriftVarint(b, int64(size))
+	b = append(b, 0x15) // 3: compressed_page_size, i32
+	b = thriftVarint(b, int64(size))
+	b = append(b, 0x2c) // 5: data_page_header, struct
+	b = append(b, 0x15) // 1: num_values, i32
+	b = thriftVarint(b, int64(n))
+	b = append(b, 0x15) // 2: encoding, i32: PLAIN
+	b = thriftVarint(b, 0)
+	b = append(b, 0x15) // 3: definition_level_encoding, i32: RLE
+	b = thriftVarint(b, 3)
+	b = append(b, 0x15) // 4: repetition_level_encoding, i32: RLE
+	b = thriftVarint(b, 3)
+	b = append(b, 0x00)
+	b = append(b, 0x00)
+	return b
+}
+
+// thriftVarint appends a thrift compact-protocol zigzag varint.
+func thriftVarint(b []byte, v int64) []byte {
+	return binary.AppendUvarint(b, uint64(v<<1)^uint64(v>>63))
+}
+
+// thriftString appends a thrift compact-protocol string payload.
+func thriftString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// thriftListHeader appends a thrift compact-protocol list header.
+func thriftListHeader(b []byte, size, elemType int) []byte {
+	if size < 15 {
+		return append(b, byte(size<<4|elemType))
+	}
+	b = append(b, byte(0xf0|elemType))
+	return binary.AppendUvarint(b, uint64(size))
+}
+
+// printProtobuf emits a length-delimited stream of StationStat
+// messages (see stationstat.proto): each message is preceded by its
+// byte length as a varint, the framing protobuf readers conventionally
+// expect for streams. The encoder is hand-rolled against the checked-in
+// schema, which keeps the binary free of a protobuf runtime the same
+// way -format sqlite avoids a database driver. -raw-tenths swaps the
+// rounded doubles for the exact integer tenths fields.
+func printProtobuf(w *bufio.Writer, ids []string, res measurements) {
+	var msg []byte
+	for _, id := range ids {
+		m := res[id]
+		msg = protoBytes(msg[:0], 1, []byte(id))
+		if opt.rawTenths {
+			msg = protoVarint(msg, 5, uint64(m.count))
+			msg = protoSint64(msg, 6, m.min)
+			msg = protoSint64(msg, 7, m.max)
+			msg = protoSint64(msg, 8, m.sum)
+		} else {
+			msg = protoDouble(msg, 2, float64(m.min)/10)
+			msg = protoDouble(msg, 3, roundJava(float64(m.sum)/float64(m.count))/10)
+			msg = protoDouble(msg, 4, float64(m.max)/10)
+			msg = protoVarint(msg, 5, uint64(m.count))
+		}
+		w.Write(binary.AppendUvarint(nil, uint64(len(msg))))
+		w.Write(msg)
+	}
+}
+
+// protoBytes appends a length-delimited field (wire type 2).
+func protoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// protoVarint appends a varint field (wire type 0).
+func protoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|0)
+	return binary.AppendUvarint(b, v)
+}
+
+// protoSint64 appends a zigzag-encoded sint64 field (wire type 0).
+func protoSint64(b []byte, field int, v int64) []byte {
+	return protoVarint(b, field, uint64(v<<1)^uint64(v>>63))
+}
+
+// protoDouble appends a double field (wire type 1, fixed64).
+func protoDouble(b []byte, field int, v float64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|1)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+// mergeResultFiles merges json result files produced by -format json.
+// Files written with -raw-tenths carry the exact sum and count and merge
+// losslessly. For the default rounded files the sum is reconstructed
+// from the rounded mean, so the merged mean is approximate: each shard's
+// rounding error, up to half a tenth per station, survives into the
+// combined mean.
+func mergeResultFiles(paths []string, output io.Writer) {
+	res := measurements{}
+	for _, path := range paths {
+		res.merge(readResultFile(path))
+	}
+	finish(res, output)
+}
+
+// readResultFile loads a json result file produced by -format json back
+// into measurements.
+func readResultFile(path string) measurements {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var entries map[string]struct {
+		Min, Mean, Max float64
+		Count          int64
+		Sum            *int64 // exact tenths, present in -raw-tenths files
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+	res := measurements{}
+	for id, e := range entries {
+		if e.Sum != nil {
+			// A -raw-tenths shard: min and max are integer tenths and the
+			// exact sum replaces the rounded mean, so no precision is lost.
+			res.mergeOne([]byte(id), &measurement{
+				min:   int64(e.Min),
+				max:   int64(e.Max),
+				sum:   *e.Sum,
+				count: e.Count,
+			})
+			continue
+		}
+		res.mergeOne([]byte(id), &measurement{
+			min:   int64(math.Round(e.Min * 10)),
+			max:   int64(math.Round(e.Max * 10)),
+			sum:   int64(math.Round(e.Mean * 10 * float64(e.Count))),
+			count: e.Count,
+		})
+	}
+	return res
+}
+
+// appendResult merges the run into an accumulating json result file for
+// incremental daily runs. The file is replaced via a temp file and
+// rename, so a crash cannot leave it corrupted.
+func appendResult(res measurements, path string) {
+	if _, err := os.Stat(path); err == nil {
+		res.merge(readResultFile(path))
+	}
+
+	ids := make([]string, 0, len(res))
+	for id := range res {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".append-*")
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := bufio.NewWriter(tmp)
+	printJSON(w, ids, res)
+	w.Flush()
+	if err := tmp.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// The -save-state checkpoint format: magic, a version byte, then for each
+// station a length-prefixed id and its four int64 aggregates, all
+// little-endian. Stations are written sorted so checkpoints are
+// byte-comparable.
+const (
+	stateMagic   = "1brc-state"
+	stateVersion = 1
+)
+
+func saveState(res measurements, path string) {
+	ids := make([]string, 0, len(res))
+	for id := range res {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var buf bytes.Buffer
+	buf.WriteString(stateMagic)
+	buf.WriteByte(stateVersion)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(ids)))
+	for _, id := range ids {
+		m := res[id]
+		binary.Write(&buf, binary.LittleEndian, uint32(len(id)))
+		buf.WriteString(id)
+		binary.Write(&buf, binary.LittleEndian, []int64{m.min, m.max, m.sum, m.count})
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func loadState(path string) measurements {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r := bytes.NewReader(data)
+
+	magic := make([]byte, len(stateMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != stateMagic {
+		log.Fatalf("%s: not a state file", path)
+	}
+	if v, _ := r.ReadByte(); v != stateVersion {
+		log.Fatalf("%s: unsupported state version %d", path, v)
+	}
+
+	var n uint32
+	readErr := func(err error) {
+		if err != nil {
+			log.Fatalf("%s: truncated state file", path)
+		}
+	}
+	readErr(binary.Read(r, binary.LittleEndian, &n))
+
+	res := make(measurements, n)
+	for ; n > 0; n-- {
+		var idLen uint32
+		readErr(binary.Read(r, binary.LittleEndian, &idLen))
+		id := make([]byte, idLen)
+		_, err := io.ReadFull(r, id)
+		readErr(err)
+		vals := make([]int64, 4)
+		readErr(binary.Read(r, binary.LittleEndian, vals))
+		res[string(id)] = &measurement{min: vals[0], max: vals[1], sum: vals[2], count: vals[3]}
+	}
+	return res
+}
+
+// aggregator consumes measurement rows from a byte stream, for inputs that
+// cannot be memory-mapped (pipes, sockets). With emitEvery set it prints a
+// snapshot of the in-progress aggregation to emitTo every emitEvery rows;
+// the caller prints the complete result after Close.
+type aggregator struct {
+	mu   sync.Mutex
+	res  measurements
+	buf  []byte // trailing partial row
+	rows int64
+
+	emitEvery int64
+	emitTo    io.Writer
+	emitted   int64 // rows at the last snapshot
+
+	// flushStop ends the -flush-interval ticker goroutine; flushIdle is
+	// closed once it has returned.
+	flushStop, flushIdle chan struct{}
+	// emitMu serializes snapshot output between Write and the flusher.
+	emitMu sync.Mutex
+
+	// -spill-dir bounds resident stations: once spillLimit is exceeded
+	// the least-recently-updated half spill to spillFile and are
+	// re-merged by result.
+	spillLimit int
+	spillFile  *os.File
+}
+
+func newAggregator() *aggregator {
+	a := &aggregator{res: measurements{}}
+	if opt.spillDir != "" {
+		a.spillLimit = opt.spillLimit
+	}
+	return a
+}
+
+func (a *aggregator) Write(p []byte) (int, error) {
+	a.mu.Lock()
+
+	data := p
+	if len(a.buf) > 0 {
+		a.buf = append(a.buf, p...)
+		data = a.buf
+	}
+	for {
+		nl := bytes.IndexByte(data, '\n')
+		if nl == -1 {
+			break
+		}
+		if nl > 0 {
+			parseRow(data[:nl], a.res)
+			a.rows++
+		}
+		data = data[nl+1:]
+	}
+	a.buf = append(a.buf[:0], data...)
+
+	if a.spillLimit > 0 && len(a.res) > a.spillLimit {
+		a.spill()
+	}
+
+	// Snapshot under the lock, format outside so ingestion by other
+	// writers is not blocked on output.
+	var snapshot measurements
+	if a.emitEvery > 0 && a.rows-a.emitted >= a.emitEvery {
+		snapshot = a.res.clone()
+		a.emitted = a.rows
+	}
+	a.mu.Unlock()
+
+	if snapshot != nil {
+		a.emitMu.Lock()
+		printResult(snapshot, a.emitTo)
+		a.emitMu.Unlock()
+	}
+	return len(p), nil
+}
+
+func (a *aggregator) Close() error {
+	a.mu.Lock()
+	if len(a.buf) > 0 {
+		parseRow(a.buf, a.res)
+		a.rows++
+		a.buf = nil
+	}
+	a.mu.Unlock()
+
+	if a.flushStop != nil {
+		close(a.flushStop)
+		<-a.flushIdle
+		a.flushStop = nil
+		// The final emit always fires so a consumer following the
+		// snapshots ends on the complete state.
+		a.flush()
+	}
+	return nil
+}
+
+// startFlusher emits partial result snapshots at most every d, capping
+// the latency of the row-count-based emit during idle periods: whichever
+// of the two fires first triggers output.
+func (a *aggregator) startFlusher(d time.Duration) {
+	a.flushStop = make(chan struct{})
+	a.flushIdle = make(chan struct{})
+	go func() {
+		defer close(a.flushIdle)
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.flushStop:
+				return
+			case <-ticker.C:
+				a.flush()
+			}
+		}
+	}()
+}
+
+// flush emits a snapshot if any rows arrived since the last one.
+func (a *aggregator) flush() {
+	a.mu.Lock()
+	var snapshot measurements
+	if a.rows > a.emitted {
+		snapshot = a.res.clone()
+		a.emitted = a.rows
+	}
+	a.mu.Unlock()
+	if snapshot != nil {
+		a.emitMu.Lock()
+		printResult(snapshot, a.emitTo)
+		a.emitMu.Unlock()
+	}
+}
+
+func (a *aggregator) result() measurements {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.unspill()
+	return a.res
+}
+
+// spill moves the least-recently-updated half of the resident stations
+// to the spill file as length-prefixed id plus min/max/sum/count
+// records, the same per-station encoding as -save-state. A station may
+// spill repeatedly; each record carries the aggregate since the previous
+// eviction and unspill re-merges them all. Called with a.mu held.
+func (a *aggregator) spill() {
+	type station struct {
+		id string
+		m  *measurement
+	}
+	resident := make([]station, 0, len(a.res))
+	for id, m := range a.res {
+		resident = append(resident, station{id, m})
+	}
+	sort.Slice(resident, func(i, j int) bool { return resident[i].m.touched < resident[j].m.touched })
+
+	var buf bytes.Buffer
+	for _, s := range resident[:len(resident)/2] {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(s.id)))
+		buf.WriteString(s.id)
+		binary.Write(&buf, binary.LittleEndian, []int64{s.m.min, s.m.max, s.m.sum, s.m.count})
+		delete(a.res, s.id)
+	}
+	if a.spillFile == nil {
+		f, err := os.CreateTemp(opt.spillDir, "spill-*")
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.spillFile = f
+	}
+	if _, err := a.spillFile.Write(buf.Bytes()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// unspill merges every spilled record back and removes the spill file.
+// Called with a.mu held.
+func (a *aggregator) unspill() {
+	if a.spillFile == nil {
+		return
+	}
+	data, err := os.ReadFile(a.spillFile.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		var idLen uint32
+		if err := binary.Read(r, binary.LittleEndian, &idLen); err != nil {
+			log.Fatalf("truncated spill file: %v", err)
+		}
+		id := make([]byte, idLen)
+		if _, err := io.ReadFull(r, id); err != nil {
+			log.Fatalf("truncated spill file: %v", err)
+		}
+		vals := make([]int64, 4)
+		if err := binary.Read(r, binary.LittleEndian, vals); err != nil {
+			log.Fatalf("truncated spill file: %v", err)
+		}
+		a.res.mergeOne(id, &measurement{min: vals[0], max: vals[1], sum: vals[2], count: vals[3]})
+	}
+	a.spillFile.Close()
+	os.Remove(a.spillFile.Name())
+	a.spillFile = nil
+}
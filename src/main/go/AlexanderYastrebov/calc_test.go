@@ -0,0 +1,2306 @@
+/*
+ *  Copyright 2023 The original authors
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// setOptions applies f to a copy of the current options and restores the
+// original when the test finishes.
+func setOptions(t *testing.T, f func(*options)) {
+	t.Helper()
+	saved := opt
+	f(&opt)
+	t.Cleanup(func() { opt = saved })
+}
+
+// result processes input and returns the formatted output.
+func result(t *testing.T, input string) string {
+	t.Helper()
+	res := process([]byte(input), 4)
+	var buf bytes.Buffer
+	printResult(res, &buf)
+	return buf.String()
+}
+
+func TestProcess(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"empty", "", "{}\n"},
+		{"single newline", "\n", "{}\n"},
+		{"only newlines", "\n\n\n", "{}\n"},
+		{"only whitespace", " \t\n \n", "{}\n"},
+		{"trailing blank line", "London;12.3\n\n", "{London=12.3/12.3/12.3}\n"},
+		{"single row", "London;12.3\n", "{London=12.3/12.3/12.3}\n"},
+		{"no trailing newline", "London;12.3", "{London=12.3/12.3/12.3}\n"},
+		{"negative", "Oslo;-9.9\nOslo;-0.1\n", "{Oslo=-9.9/-5.0/-0.1}\n"},
+		{
+			"multiple stations",
+			"Hamburg;12.0\nBulawayo;8.9\nPalembang;38.8\nHamburg;34.2\n",
+			"{Bulawayo=8.9/8.9/8.9, Hamburg=12.0/23.1/34.2, Palembang=38.8/38.8/38.8}\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := result(t, tc.input); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestQuotedIds(t *testing.T) {
+	setOptions(t, func(o *options) { o.quotedIds = true })
+
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"separator inside quotes", "\"Foo;Bar\";12.3\n", "{Foo;Bar=12.3/12.3/12.3}\n"},
+		{"escaped quote", "\"Foo\"\"Bar\";1.0\n", "{Foo\"Bar=1.0/1.0/1.0}\n"},
+		{
+			"mixed with unquoted",
+			"\"Foo;Bar\";2.0\nLondon;1.0\n\"Foo;Bar\";4.0\n",
+			"{Foo;Bar=2.0/3.0/4.0, London=1.0/1.0/1.0}\n",
+		},
+		{"quoted without newline", "\"Foo;Bar\";12.3", "{Foo;Bar=12.3/12.3/12.3}\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := result(t, tc.input); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLimit(t *testing.T) {
+	setOptions(t, func(o *options) { o.limit = 2 })
+
+	input := "a;1.0\nb;2.0\nc;3.0\nd;4.0\n"
+	res := process([]byte(input), 1)
+	var total int64
+	for _, m := range res {
+		total += m.count
+	}
+	if total != 2 {
+		t.Errorf("got %d rows, want 2", total)
+	}
+
+	// With parallel chunks which rows are consumed depends on scheduling,
+	// but the total stays exact.
+	res = process([]byte(input), 4)
+	total = 0
+	for _, m := range res {
+		total += m.count
+	}
+	if total != 2 {
+		t.Errorf("got %d rows with 4 workers, want 2", total)
+	}
+}
+
+func TestEmitInterval(t *testing.T) {
+	var snapshots bytes.Buffer
+	a := newAggregator()
+	a.emitEvery = 2
+	a.emitTo = &snapshots
+
+	for _, row := range []string{"a;1.0\n", "b;2.0\n", "a;3.0\n", "b;4.0\n", "c;5.0\n"} {
+		if _, err := a.Write([]byte(row)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+
+	want := "{a=1.0/1.0/1.0, b=2.0/2.0/2.0}\n" +
+		"{a=1.0/2.0/3.0, b=2.0/3.0/4.0}\n"
+	if got := snapshots.String(); got != want {
+		t.Errorf("snapshots:\ngot  %q\nwant %q", got, want)
+	}
+
+	var final bytes.Buffer
+	printResult(a.result(), &final)
+	if got, want := final.String(), "{a=1.0/2.0/3.0, b=2.0/3.0/4.0, c=5.0/5.0/5.0}\n"; got != want {
+		t.Errorf("final: got %q, want %q", got, want)
+	}
+}
+
+func TestWriteGoldenRoundTrip(t *testing.T) {
+	golden := t.TempDir() + "/golden.txt"
+	setOptions(t, func(o *options) { o.writeGolden = golden })
+
+	res := process([]byte("London;12.3\nOslo;-3.4\n"), 4)
+	var out bytes.Buffer
+	finish(res, &out)
+
+	written, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, out.Bytes()) {
+		t.Errorf("golden %q does not match output %q", written, out.Bytes())
+	}
+
+	// The golden file verifies via -compare.
+	setOptions(t, func(o *options) { o.writeGolden = ""; o.compare = golden })
+	out.Reset()
+	finish(res, &out)
+}
+
+func TestTimestamps(t *testing.T) {
+	setOptions(t, func(o *options) { o.timestamps = true })
+
+	input := "a;3.0;t1\na;1.0;t2\na;5.0;t3\na;5.0;t4\n"
+	want := "{a=1.0@t2/3.5/5.0@t3}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestScientific(t *testing.T) {
+	setOptions(t, func(o *options) { o.scientific = true })
+
+	input := "a;1.2e1\na;-3.4e-1\nb;12.3\n"
+	want := "{a=-0.3/5.9/12.0, b=12.3/12.3/12.3}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHighCardinality(t *testing.T) {
+	// Enough distinct stations to outgrow the pre-sized buckets.
+	const n = 3 * nBuckets / 2
+	var input bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&input, "station-%06d;1.0\n", i)
+	}
+	res := process(input.Bytes(), 1)
+	if len(res) != n {
+		t.Errorf("got %d stations, want %d", len(res), n)
+	}
+}
+
+func TestJavaCompat(t *testing.T) {
+	setOptions(t, func(o *options) { o.javaCompat = true; o.format = "json"; o.noSort = true })
+
+	// Captured from the reference Java implementation.
+	input := "Abha;-23.0\nAbha;59.2\nAbidjan;-0.1\nAbidjan;0.1\nAbidjan;-0.1\n"
+	want := "{Abha=-23.0/18.1/59.2, Abidjan=-0.1/0.0/0.1}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGroupByPrefix(t *testing.T) {
+	setOptions(t, func(o *options) { o.groupPrefix = "/" })
+
+	input := "US/CA/SF;1.0\nUS/NY;3.0\nEU/DE;2.0\nSolo;4.0\n"
+	want := "{EU=2.0/2.0/2.0, Solo=4.0/4.0/4.0, US=1.0/2.0/3.0}\n"
+	if got := func() string {
+		res := process([]byte(input), 4)
+		var buf bytes.Buffer
+		finish(res, &buf)
+		return buf.String()
+	}(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	setOptions(t, func(o *options) { o.alsoDetail = true })
+	want += "{EU/DE=2.0/2.0/2.0, Solo=4.0/4.0/4.0, US/CA/SF=1.0/1.0/1.0, US/NY=3.0/3.0/3.0}\n"
+	res := process([]byte(input), 4)
+	var buf bytes.Buffer
+	finish(res, &buf)
+	if got := buf.String(); got != want {
+		t.Errorf("with -also-detail: got %q, want %q", got, want)
+	}
+}
+
+func TestParseNumberBE(t *testing.T) {
+	// Emulate the big-endian path: a natively loaded big-endian word must
+	// decode identically to the little-endian one on every valid input.
+	for tenths := -999; tenths <= 999; tenths++ {
+		sign := ""
+		if tenths < 0 {
+			sign = "-"
+		}
+		a := abs(tenths)
+		b := []byte(fmt.Sprintf("%s%d.%d\nxxxxxxx", sign, a/10, a%10))
+		le := binary.LittleEndian.Uint64(b)
+		be := binary.BigEndian.Uint64(b)
+
+		lv, ln := parseNumberLE(le)
+		bv, bn := parseNumberBE(be)
+		if lv != bv || ln != bn {
+			t.Fatalf("tenths %d: LE (%d, %d) != BE (%d, %d)", tenths, lv, ln, bv, bn)
+		}
+		if lv != int64(tenths) {
+			t.Fatalf("tenths %d: parsed %d", tenths, lv)
+		}
+	}
+}
+
+func TestMissingReadings(t *testing.T) {
+	// An empty temperature field is skipped on the default fast path.
+	input := "a;1.0\na;\na;3.0\n"
+	want := "{a=1.0/2.0/3.0}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("empty field: got %q, want %q", got, want)
+	}
+
+	setOptions(t, func(o *options) { o.nullValue = "999.9" })
+	input = "a;1.0\na;999.9\na;3.0\nb;999.9\n"
+	want = "{a=1.0/2.0/3.0}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("sentinel: got %q, want %q", got, want)
+	}
+	if m := process([]byte(input), 1)["a"]; m.count != 2 {
+		t.Errorf("sentinel rows contributed to count: got %d, want 2", m.count)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	setOptions(t, func(o *options) { o.checksum = true })
+
+	sum := func(input string, workers int) string {
+		var buf bytes.Buffer
+		finish(process([]byte(input), workers), &buf)
+		return buf.String()
+	}
+
+	same := "b;2.0\na;1.0\n"
+	if s1, s2 := sum(same, 1), sum("a;1.0\nb;2.0\n", 4); s1 != s2 {
+		t.Errorf("equal aggregations hash differently: %q vs %q", s1, s2)
+	}
+	if s1, s2 := sum(same, 1), sum("a;1.0\nb;2.1\n", 1); s1 == s2 {
+		t.Errorf("different aggregations hash identically: %q", s1)
+	}
+}
+
+func TestSignToken(t *testing.T) {
+	setOptions(t, func(o *options) { o.signToken = "-" })
+	if got, want := result(t, "a;-;12.3\na;+;1.0\n"), "{a=-12.3/-5.6/1.0}\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	setOptions(t, func(o *options) { o.signToken = "N" })
+	if got, want := result(t, "a;N;2.0\na;P;2.0\n"), "{a=-2.0/0.0/2.0}\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSaveLoadState(t *testing.T) {
+	state := t.TempDir() + "/state.bin"
+
+	setOptions(t, func(o *options) { o.saveState = state })
+	finish(process([]byte("a;1.0\nb;2.0\n"), 4), io.Discard)
+
+	setOptions(t, func(o *options) { o.saveState = ""; o.loadState = state })
+	var buf bytes.Buffer
+	finish(process([]byte("a;3.0\nc;4.0\n"), 4), &buf)
+
+	want := "{a=1.0/2.0/3.0, b=2.0/2.0/2.0, c=4.0/4.0/4.0}\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func benchmarkInput(rows int) []byte {
+	var input bytes.Buffer
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&input, "station-%03d;%d.%d\n", i%413, i%100-50, i%10)
+	}
+	return input.Bytes()
+}
+
+func BenchmarkProcess(b *testing.B) {
+	data := benchmarkInput(100000)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		process(data, 4)
+	}
+}
+
+// Chunk starts fall on arbitrary newline boundaries, so the 8-byte number
+// loads are mostly unaligned. This pair measures whether realigning would
+// pay off; on amd64 and arm64 the difference is below noise, so chunk
+// boundaries are left as they are.
+func BenchmarkLoadNumberWord(b *testing.B) {
+	data := make([]byte, 64*1024+8)
+	for _, bc := range []struct {
+		name string
+		off  int
+	}{
+		{"aligned", 0},
+		{"unaligned", 1},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var sink uint64
+			for i := 0; i < b.N; i++ {
+				for off := bc.off; off+8 <= len(data); off += 8 {
+					sink += loadNumberWord(data[off:])
+				}
+			}
+			if sink == 1 {
+				b.Fatal("unreachable")
+			}
+		})
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	setOptions(t, func(o *options) { o.caseFold = true })
+
+	input := "London;1.0\nLONDON;3.0\nlondon;2.0\n"
+	want := "{london=1.0/2.0/3.0}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Non-ASCII letters are not folded.
+	input = "Östersund;1.0\nöstersund;2.0\n"
+	want = "{Östersund=1.0/1.0/1.0, östersund=2.0/2.0/2.0}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStripSuffix(t *testing.T) {
+	setOptions(t, func(o *options) { o.stripSuffix = true })
+
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"ascii unit", "a;12.3C\na;-1.0C\n", "{a=-1.0/5.7/12.3}\n"},
+		{"degree unit", "a;5.0°C\nb;-3.4°C\n", "{a=5.0/5.0/5.0, b=-3.4/-3.4/-3.4}\n"},
+		{"no suffix", "a;5.0\na;7.0\n", "{a=5.0/6.0/7.0}\n"},
+		{"suffix on trailing row", "a;1.0C\nb;2.0°C", "{a=1.0/1.0/1.0, b=2.0/2.0/2.0}\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := result(t, tc.input); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWarnMerges(t *testing.T) {
+	setOptions(t, func(o *options) { o.caseFold = true; o.warnMerges = true })
+	t.Cleanup(func() { rawForms.forms = nil })
+
+	process([]byte("Foo;1.0\nFOO;2.0\nBar;3.0\n"), 1)
+	if got := len(rawForms.forms["foo"]); got != 2 {
+		t.Errorf("tracked %d raw forms for foo, want 2", got)
+	}
+	if got := len(rawForms.forms["bar"]); got != 1 {
+		t.Errorf("tracked %d raw forms for bar, want 1", got)
+	}
+}
+
+func TestFormatNDJSON(t *testing.T) {
+	setOptions(t, func(o *options) { o.format = "ndjson" })
+
+	input := "b;2.0\na;1.0\na;2.0\n"
+	want := `{"station":"a","min":1.0,"mean":1.5,"max":2.0,"count":2}` + "\n" +
+		`{"station":"b","min":2.0,"mean":2.0,"max":2.0,"count":1}` + "\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestAppendResult(t *testing.T) {
+	path := t.TempDir() + "/daily.json"
+	setOptions(t, func(o *options) { o.appendFile = path })
+
+	var out bytes.Buffer
+	finish(process([]byte("a;1.0\nb;2.0\n"), 4), &out)
+	finish(process([]byte("a;3.0\nc;4.0\n"), 4), &out)
+
+	if out.Len() != 0 {
+		t.Errorf("append run also wrote %q to the main output", out.String())
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":{"min":1.0,"mean":2.0,"max":3.0,"count":2},` +
+		`"b":{"min":2.0,"mean":2.0,"max":2.0,"count":1},` +
+		`"c":{"min":4.0,"mean":4.0,"max":4.0,"count":1}}` + "\n"
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPageMultipleFile(t *testing.T) {
+	// A file whose size is an exact page multiple has no zero-filled
+	// mmap padding after it; the padded mapping must still allow word
+	// loads at EOF.
+	var input bytes.Buffer
+	target := syscall.Getpagesize()
+	for input.Len() < target-16 {
+		input.WriteString("London;2.0\n")
+	}
+	rest := target - input.Len()
+	input.WriteString(strings.Repeat("x", rest-5) + ";9.9\n")
+	if input.Len() != target {
+		t.Fatalf("constructed %d bytes, want %d", input.Len(), target)
+	}
+
+	path := t.TempDir() + "/page-multiple.txt"
+	if err := os.WriteFile(path, input.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	processFile(path, &out)
+	want := fmt.Sprintf("{London=2.0/2.0/2.0, %s=9.9/9.9/9.9}\n", strings.Repeat("x", rest-5))
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestOnly(t *testing.T) {
+	input := "a;1.0\na;2.0\nb;5.0\n"
+	for _, tc := range []struct {
+		only, format string
+		want         string
+	}{
+		{"mean", "brace", "{a=1.5, b=5.0}\n"},
+		{"min", "brace", "{a=1.0, b=5.0}\n"},
+		{"max", "json", `{"a":2.0,"b":5.0}` + "\n"},
+		{"count", "csv", "station,count\na,2\nb,1\n"},
+	} {
+		t.Run(tc.only+"/"+tc.format, func(t *testing.T) {
+			setOptions(t, func(o *options) { o.only = tc.only; o.format = tc.format })
+			if got := result(t, input); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestByteOrderMark(t *testing.T) {
+	input := "\xef\xbb\xbfLondon;12.3\nOslo;-3.4\n"
+	want := "{London=12.3/12.3/12.3, Oslo=-3.4/-3.4/-3.4}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	setOptions(t, func(o *options) { o.strict = true })
+
+	input := "a;1.0\nb;-23.4\na;2.0\n"
+	want := "{a=1.0/1.5/2.0, b=-23.4/-23.4/-23.4}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestValidRow(t *testing.T) {
+	for _, tc := range []struct {
+		row string
+		ok  bool
+	}{
+		{"London;12.3", true},
+		{"London;-12.3", true},
+		{"London;1.2", true},
+		{"London;-0.0", true},
+		{";12.3", false},
+		{"London;", false},
+		{"London", false},
+		{"London;12", false},
+		{"London;12.34", false},
+		{"London;123.4", false},
+		{"London;1,2", false},
+		{"London;12.x", false},
+		{"London;--1.2", false},
+		{"London;12.3;extra", false},
+	} {
+		if _, _, ok := validRow([]byte(tc.row)); ok != tc.ok {
+			t.Errorf("validRow(%q) = %v, want %v", tc.row, ok, tc.ok)
+		}
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	setOptions(t, func(o *options) { o.weighted = true })
+
+	weighted := result(t, "a;10.0;3\na;20.0;1\nb;5.0;2\n")
+
+	// The weighted mean must match expanding each row into its samples.
+	setOptions(t, func(o *options) { o.weighted = false })
+	expanded := result(t, "a;10.0\na;10.0\na;10.0\na;20.0\nb;5.0\nb;5.0\n")
+
+	if weighted != expanded {
+		t.Errorf("weighted %q does not match expanded %q", weighted, expanded)
+	}
+	if want := "{a=10.0/12.5/20.0, b=5.0/5.0/5.0}\n"; weighted != want {
+		t.Errorf("got %q, want %q", weighted, want)
+	}
+}
+
+func TestAutoSep(t *testing.T) {
+	sepTable = buildSepTable(";,")
+	t.Cleanup(func() { sepTable = nil })
+
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"mixed separators", "a;1.0\na,2.0\nb,3.0\n", "{a=1.0/1.5/2.0, b=3.0/3.0/3.0}\n"},
+		{"mixed without newline", "a,1.0\nb;2.0", "{a=1.0/1.0/1.0, b=2.0/2.0/2.0}\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := result(t, tc.input); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatGo(t *testing.T) {
+	setOptions(t, func(o *options) { o.format = "go" })
+
+	input := "a;1.0\na;2.5\nOslo;-3.4\n"
+	want := "map[string]measurement{\n" +
+		"\t\"Oslo\": {min: -34, max: -34, sum: -34, count: 1},\n" +
+		"\t\"a\": {min: 10, max: 25, sum: 35, count: 2},\n" +
+		"}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	setOptions(t, func(o *options) { o.dedupe = true })
+
+	// Duplicate pairs only count once, even when they land in different
+	// chunks.
+	input := "a;1.0\na;1.0\na;2.0\na;2.0\na;1.0\nb;5.0\nb;5.0\n"
+	want := "{a=1.0/1.5/2.0, b=5.0/5.0/5.0}\n"
+	for _, workers := range []int{1, 4} {
+		res := process([]byte(input), workers)
+		var buf bytes.Buffer
+		printResult(res, &buf)
+		if got := buf.String(); got != want {
+			t.Errorf("%d workers: got %q, want %q", workers, got, want)
+		}
+		if got := res["a"].count; got != 2 {
+			t.Errorf("%d workers: a has count %d, want 2 distinct values", workers, got)
+		}
+	}
+}
+
+func TestHashStats(t *testing.T) {
+	setOptions(t, func(o *options) { o.hashStats = true })
+	t.Cleanup(func() { chainLengths.lengths = nil })
+
+	process([]byte("a;1.0\nb;2.0\nc;3.0\nd;4.0\n"), 1)
+	var report bytes.Buffer
+	reportHashStats(&report)
+
+	// One chunk table with three chains of length one; the last row is
+	// the separately parsed tail and never enters a chunk table.
+	want := fmt.Sprintf("hash-stats: buckets=%d max=1 mean=%.3f p99=0\n", nBuckets, 3.0/nBuckets)
+	if got := report.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWritePartitions(t *testing.T) {
+	dir := t.TempDir()
+	setOptions(t, func(o *options) { o.partitionDir = dir })
+
+	input := "Athens;1.0\nAmsterdam;2.0\nBerlin;3.0\n"
+	res := process([]byte(input), 4)
+	var out bytes.Buffer
+	finish(res, &out)
+
+	if out.Len() != 0 {
+		t.Errorf("partitioned run also wrote %q to the main output", out.String())
+	}
+	for file, want := range map[string]string{
+		"A.txt": "{Amsterdam=2.0/2.0/2.0, Athens=1.0/1.0/1.0}\n",
+		"B.txt": "{Berlin=3.0/3.0/3.0}\n",
+	} {
+		got, err := os.ReadFile(dir + "/" + file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", file, got, want)
+		}
+	}
+
+	setOptions(t, func(o *options) { o.partitionBy = "segment" })
+	if got, want := partitionKey("US/CA/SF"), "US"; got != want {
+		t.Errorf("segment key: got %q, want %q", got, want)
+	}
+}
+
+func TestProcessURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "a;1.0\nb;2.0\n")
+	}))
+	defer srv.Close()
+
+	var out bytes.Buffer
+	processURL(srv.URL, &out)
+	if got, want := out.String(), "{a=1.0/1.0/1.0, b=2.0/2.0/2.0}\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestProcessContext(t *testing.T) {
+	input := []byte("a;1.0\nb;2.0\n")
+
+	res, err := ProcessContext(context.Background(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Errorf("got %d stations, want 2", len(res))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if res, err = ProcessContext(ctx, input); err != context.Canceled {
+		t.Errorf("got (%v, %v), want context.Canceled", res, err)
+	}
+}
+
+func TestFixedWidth(t *testing.T) {
+	setOptions(t, func(o *options) { o.fixed = "id=8,temp=6" })
+
+	input := "London    12.3" +
+		"Oslo      -3.4" +
+		"London    -0.5" +
+		"Oslo          " // all-space temperature: missing reading
+	want := "{London=-0.5/5.9/12.3, Oslo=-3.4/-3.4/-3.4}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMinmaxRows(t *testing.T) {
+	setOptions(t, func(o *options) { o.minmaxRows = true })
+
+	// Row indices are global across the file; ties keep the first
+	// occurrence. The trailing row without a newline still gets an index.
+	input := "a;5.0\nb;1.0\na;-2.0\nb;9.9\na;-2.0\nb;1.0\na;7.5"
+	want := "{a=-2.0#2/2.1/7.5#6, b=1.0#1/4.0/9.9#3}\n"
+	for _, workers := range []int{1, 4} {
+		res := process([]byte(input), workers)
+		var buf bytes.Buffer
+		printResult(res, &buf)
+		if got := buf.String(); got != want {
+			t.Errorf("%d workers: got %q, want %q", workers, got, want)
+		}
+	}
+}
+
+func TestWorkerCountDeterminism(t *testing.T) {
+	// Temperatures accumulate as int64 tenths, so for a fixed input the
+	// output must be bit-identical regardless of how the chunks are split
+	// or scheduled.
+	var input bytes.Buffer
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&input, "station-%02d;%d.%d\n", i%37, i%100-50, i%10)
+	}
+
+	var want string
+	for _, workers := range []int{1, 2, 4, 16} {
+		res := process(input.Bytes(), workers)
+		var buf bytes.Buffer
+		printResult(res, &buf)
+		got := buf.String()
+		if want == "" {
+			want = got
+		} else if got != want {
+			t.Errorf("%d workers: output differs from 1 worker:\ngot  %q\nwant %q", workers, got, want)
+		}
+	}
+}
+
+func TestExcludeFile(t *testing.T) {
+	excludeFile := t.TempDir() + "/exclude.txt"
+	if err := os.WriteFile(excludeFile, []byte("b\nd\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	excludeSet = loadExclude(excludeFile)
+	t.Cleanup(func() { excludeSet = nil })
+
+	input := "a;1.0\nb;99.9\nc;3.0\nd;-99.9\na;2.0\n"
+	want := "{a=1.0/1.5/2.0, c=3.0/3.0/3.0}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The scalar row path excludes too.
+	res := measurements{}
+	parseRow([]byte("b;5.0\n"), res)
+	parseRow([]byte("a;5.0\n"), res)
+	if len(res) != 1 || res["a"] == nil {
+		t.Errorf("scalar path recorded %v, want only a", res)
+	}
+
+	// The run-based paths flush whole runs, so they must drop excluded
+	// runs rather than bypass the per-row guard.
+	sorted := "a;1.0\na;2.0\nb;99.9\nc;3.0\nd;-99.9\n"
+	setOptions(t, func(o *options) { o.sortedInput = true })
+	if got := result(t, sorted); got != want {
+		t.Errorf("sorted input: got %q, want %q", got, want)
+	}
+
+	setOptions(t, func(o *options) { o.sortedInput = false; o.strict = true })
+	if got := result(t, input); got != want {
+		t.Errorf("strict: got %q, want %q", got, want)
+	}
+
+	setOptions(t, func(o *options) { o.strict = false; o.sortedInput = true; o.stream = true })
+	var buf bytes.Buffer
+	streamSorted([]byte(sorted), &buf)
+	if got := buf.String(); got != want {
+		t.Errorf("stream: got %q, want %q", got, want)
+	}
+}
+
+func TestMaybeGzip(t *testing.T) {
+	input := "a;1.0\nb;2.0\n"
+	want := "{a=1.0/1.0/1.0, b=2.0/2.0/2.0}\n"
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(input))
+	zw.Close()
+
+	for name, r := range map[string]io.Reader{
+		"plain": bytes.NewReader([]byte(input)),
+		"gzip":  &compressed,
+	} {
+		var out bytes.Buffer
+		processStream(maybeGzip(r), &out)
+		if got := out.String(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestOrderFile(t *testing.T) {
+	orderFile := t.TempDir() + "/order.txt"
+	if err := os.WriteFile(orderFile, []byte("c\nmissing\na\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	setOptions(t, func(o *options) { o.orderFile = orderFile })
+
+	input := "a;1.0\nb;2.0\nc;3.0\nd;4.0\n"
+	want := "{c=3.0/3.0/3.0, a=1.0/1.0/1.0, b=2.0/2.0/2.0, d=4.0/4.0/4.0}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	setOptions(t, func(o *options) { o.omitUnlisted = true })
+	want = "{c=3.0/3.0/3.0, a=1.0/1.0/1.0}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("with -omit-unlisted: got %q, want %q", got, want)
+	}
+}
+
+func TestNormalizeDeterministicKey(t *testing.T) {
+	setOptions(t, func(o *options) { o.normalize = true })
+
+	// Distinct raw ids that normalize to the same station must aggregate
+	// under the normalized form regardless of which raw form comes first.
+	inputs := []string{
+		"  Foo;1.0\nFoo  ;3.0\nFoo;2.0\n",
+		"Foo;2.0\nFoo  ;3.0\n  Foo;1.0\n",
+	}
+	want := "{Foo=1.0/2.0/3.0}\n"
+	for _, input := range inputs {
+		if got := result(t, input); got != want {
+			t.Errorf("input %q: got %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestSWARIds(t *testing.T) {
+	// Ids of varied length so the word loop exercises a partial first
+	// word, exact multiples of 8 and the byte-assembled near-EOF path.
+	input := "a;1.0\n" +
+		"exactly8;2.0\n" +
+		"sixteen-byte-id.;3.0\n" +
+		"a station name well past eight bytes;4.0\n" +
+		"exactly8;-3.5\n" +
+		"a;2.0\n"
+
+	var want string
+	{
+		var buf bytes.Buffer
+		printResult(process([]byte(input), 1), &buf)
+		want = buf.String()
+	}
+
+	setOptions(t, func(o *options) { o.swarIds = true })
+	for _, workers := range []int{1, 4} {
+		var buf bytes.Buffer
+		printResult(process([]byte(input), workers), &buf)
+		if got := buf.String(); got != want {
+			t.Errorf("workers=%d: got %q, want %q", workers, got, want)
+		}
+	}
+}
+
+func TestSWARIdsExclude(t *testing.T) {
+	// -swar-ids does not hash ids with FNV-1a, so the exclude check must
+	// not key the exclude set by the table hash.
+	setOptions(t, func(o *options) { o.swarIds = true })
+	excludeSet = map[uint64]string{fnvHash([]byte("long-excluded-station")): "long-excluded-station"}
+	t.Cleanup(func() { excludeSet = nil })
+
+	input := "long-excluded-station;1.0\nother-long-station;2.0\n"
+	want := "{other-long-station=2.0/2.0/2.0}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func benchmarkInputLongIds(rows int) []byte {
+	var input bytes.Buffer
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&input, "observatory-with-a-rather-long-name-%03d;%d.%d\n", i%413, i%100-50, i%10)
+	}
+	return input.Bytes()
+}
+
+func BenchmarkProcessSWARLongIds(b *testing.B) {
+	data := benchmarkInputLongIds(100000)
+	for _, bc := range []struct {
+		name string
+		swar bool
+	}{
+		{"bytewise", false},
+		{"swar", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			prev := opt
+			opt.swarIds = bc.swar
+			b.Cleanup(func() { opt = prev })
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				process(data, 4)
+			}
+		})
+	}
+}
+
+func TestOrderTempFirst(t *testing.T) {
+	stationFirst := "London;1.0\nParis;-3.5\nLondon;2.0\nOslo;0.4\n"
+	tempFirst := "1.0;London\n-3.5;Paris\n2.0;London\n0.4;Oslo\n"
+
+	want := result(t, stationFirst)
+
+	setOptions(t, func(o *options) { o.order = "temp-first" })
+	for _, workers := range []int{1, 4} {
+		var buf bytes.Buffer
+		printResult(process([]byte(tempFirst), workers), &buf)
+		if got := buf.String(); got != want {
+			t.Errorf("workers=%d: got %q, want %q", workers, got, want)
+		}
+	}
+
+	// Missing trailing newline exercises the separately parsed tail row.
+	if got := result(t, strings.TrimSuffix(tempFirst, "\n")); got != want {
+		t.Errorf("no trailing newline: got %q, want %q", got, want)
+	}
+}
+
+func TestMeanMode(t *testing.T) {
+	// 1.0 and 1.1 average to 1.05, which the default mode rounds up.
+	input := "a;1.0\na;1.1\n"
+	for _, tc := range []struct {
+		mode string
+		want string
+	}{
+		{"round", "{a=1.0/1.1/1.1}\n"},
+		{"exact", "{a=1.0/1.05/1.1}\n"},
+		{"highprec", "{a=1.0/1.050000/1.1}\n"},
+	} {
+		setOptions(t, func(o *options) { o.meanMode = tc.mode })
+		if got := result(t, input); got != tc.want {
+			t.Errorf("mode %s: got %q, want %q", tc.mode, got, tc.want)
+		}
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	if err := selfTest(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	setOptions(t, func(o *options) { o.compact = true })
+
+	input := "b;2.0\na;1.0\n"
+	want := "{a=1.0/1.0/1.0,b=2.0/2.0/2.0}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDebugOverlapAssertion(t *testing.T) {
+	setOptions(t, func(o *options) { o.debug = true })
+
+	// Minimal rows put the number read as close to the chunk end as the
+	// grammar allows; the assertion must hold on every boundary.
+	var input bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&input, "s%d;%d.%d\n", i%7, i%10, i%10)
+	}
+	want := result(t, input.String())
+	setOptions(t, func(o *options) { o.debug = false })
+	if got := result(t, input.String()); got != want {
+		t.Errorf("-debug changed the result: got %q, want %q", want, got)
+	}
+}
+
+func TestFormatTable(t *testing.T) {
+	setOptions(t, func(o *options) { o.format = "table" })
+
+	input := "Oslo;-3.4\nOslo;2.0\nReykjavik;1.0\n"
+	want := "    Station   Min  Mean  Max  Count\n" +
+		"       Oslo  -3.4  -0.7  2.0      2\n" +
+		"  Reykjavik   1.0   1.0  1.0      1\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSortedInput(t *testing.T) {
+	input := "Athens;5.0\nAthens;7.0\nBergen;1.0\nBergen;-2.0\nBergen;3.0\nCairo;30.1\n"
+	want := result(t, input)
+
+	setOptions(t, func(o *options) { o.sortedInput = true })
+	for _, workers := range []int{1, 4} {
+		var buf bytes.Buffer
+		printResult(process([]byte(input), workers), &buf)
+		if got := buf.String(); got != want {
+			t.Errorf("workers=%d: got %q, want %q", workers, got, want)
+		}
+	}
+
+	// Unsorted input is out of contract but still aggregates correctly,
+	// just without the run optimization paying off.
+	unsorted := "Bergen;1.0\nAthens;5.0\nBergen;-2.0\nCairo;30.1\nAthens;7.0\nBergen;3.0\n"
+	if got := result(t, unsorted); got != want {
+		t.Errorf("unsorted: got %q, want %q", got, want)
+	}
+}
+
+func BenchmarkProcessSortedInput(b *testing.B) {
+	rows := bytes.Split(bytes.TrimSuffix(benchmarkInput(100000), []byte("\n")), []byte("\n"))
+	sort.Slice(rows, func(i, j int) bool { return bytes.Compare(rows[i], rows[j]) < 0 })
+	data := append(bytes.Join(rows, []byte("\n")), '\n')
+	for _, bc := range []struct {
+		name   string
+		sorted bool
+	}{
+		{"hashed", false},
+		{"runs", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			prev := opt
+			opt.sortedInput = bc.sorted
+			b.Cleanup(func() { opt = prev })
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				process(data, 4)
+			}
+		})
+	}
+}
+
+func TestFormatSQLite(t *testing.T) {
+	setOptions(t, func(o *options) { o.format = "sqlite" })
+
+	input := "O'Brien;1.0\nOslo;-3.4\nOslo;2.0\n"
+	want := "CREATE TABLE IF NOT EXISTS measurements (station TEXT PRIMARY KEY, min REAL, mean REAL, max REAL, count INTEGER);\n" +
+		"BEGIN;\n" +
+		"INSERT INTO measurements VALUES\n" +
+		"('O''Brien',1.0,1.0,1.0,1),\n" +
+		"('Oslo',-3.4,-0.7,2.0,2);\n" +
+		"COMMIT;\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	setOptions(t, func(o *options) { o.rawTenths = true })
+	want = "CREATE TABLE IF NOT EXISTS measurements (station TEXT PRIMARY KEY, min INTEGER, max INTEGER, sum INTEGER, count INTEGER);\n" +
+		"BEGIN;\n" +
+		"INSERT INTO measurements VALUES\n" +
+		"('O''Brien',10,10,10,1),\n" +
+		"('Oslo',-34,20,-14,2);\n" +
+		"COMMIT;\n"
+	if got := result(t, input); got != want {
+		t.Errorf("raw tenths: got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestOffsetTenths(t *testing.T) {
+	input := "a;1.0\na;2.0\nb;-0.3\n"
+	for _, tc := range []struct {
+		offset int64
+		want   string
+	}{
+		{3, "{a=1.3/1.8/2.3, b=0.0/0.0/0.0}\n"},
+		{-15, "{a=-0.5/0.0/0.5, b=-1.8/-1.8/-1.8}\n"},
+	} {
+		setOptions(t, func(o *options) { o.offsetTenths = tc.offset })
+		if got := result(t, input); got != tc.want {
+			t.Errorf("offset %d: got %q, want %q", tc.offset, got, tc.want)
+		}
+	}
+}
+
+func TestSpillDir(t *testing.T) {
+	setOptions(t, func(o *options) { o.spillDir = t.TempDir(); o.spillLimit = 4 })
+
+	var input bytes.Buffer
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&input, "s%02d;%d.0\n", i%10, i%7)
+	}
+
+	a := newAggregator()
+	if _, err := a.Write(input.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	if resident := len(a.res); resident > 10 {
+		t.Errorf("resident stations %d, want at most 10", resident)
+	}
+	if a.spillFile == nil {
+		t.Fatal("nothing spilled despite the limit")
+	}
+
+	var got bytes.Buffer
+	printResult(a.result(), &got)
+
+	setOptions(t, func(o *options) { o.spillDir = "" })
+	want := result(t, input.String())
+	if got.String() != want {
+		t.Errorf("got %q, want %q", got.String(), want)
+	}
+}
+
+func TestLeadingZeros(t *testing.T) {
+	// Zero-padded exports like "05.6" exercise the dot-position digit
+	// detection: the pad is an ordinary digit and contributes zero, in
+	// both the word-wise and byte-wise parsers, with and without sign.
+	for _, tc := range []struct {
+		in   string
+		want int64
+	}{
+		{"00.0", 0},
+		{"05.6", 56},
+		{"-00.3", -3},
+		{"-09.9", -99},
+	} {
+		b := []byte(tc.in + "\nxxxxxxx")
+		if v, n := parseNumberLE(binary.LittleEndian.Uint64(b)); v != tc.want || n != len(tc.in)+1 {
+			t.Errorf("parseNumberLE(%q) = (%d, %d), want (%d, %d)", tc.in, v, n, tc.want, len(tc.in)+1)
+		}
+		if v, n := parseNumberBE(binary.BigEndian.Uint64(b)); v != tc.want || n != len(tc.in)+1 {
+			t.Errorf("parseNumberBE(%q) = (%d, %d), want (%d, %d)", tc.in, v, n, tc.want, len(tc.in)+1)
+		}
+		if v := parseNumber([]byte(tc.in)); v != tc.want {
+			t.Errorf("parseNumber(%q) = %d, want %d", tc.in, v, tc.want)
+		}
+	}
+
+	input := "a;05.6\na;-00.3\nb;00.0\nb;-09.9\n"
+	want := "{a=-0.3/2.7/5.6, b=-9.9/-4.9/0.0}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestValidateUTF8(t *testing.T) {
+	setOptions(t, func(o *options) { o.validateUTF8 = true; o.skipInvalidUTF8 = true })
+
+	input := "M\xfcnchen;1.0\nOslo;2.0\n" // latin1 ü is not valid UTF-8
+	var out bytes.Buffer
+	finish(process([]byte(input), 1), &out)
+	want := "{Oslo=2.0/2.0/2.0}\n"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Without skipping, the invalid id is only reported, not dropped.
+	setOptions(t, func(o *options) { o.skipInvalidUTF8 = false })
+	out.Reset()
+	finish(process([]byte(input), 1), &out)
+	want = "{M\xfcnchen=1.0/1.0/1.0, Oslo=2.0/2.0/2.0}\n"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMergeRawTenths(t *testing.T) {
+	// Values chosen so every shard mean rounds: merging the rounded json
+	// files would drift, while sum+count shards reconstruct the exact
+	// concatenated result.
+	shards := []string{
+		"a;1.1\na;1.2\nb;5.0\n",
+		"a;1.2\nb;-3.3\n",
+		"a;-0.1\nb;0.2\nb;0.2\n",
+	}
+	dir := t.TempDir()
+	setOptions(t, func(o *options) { o.format = "json"; o.rawTenths = true })
+	var paths []string
+	for i, shard := range shards {
+		path := fmt.Sprintf("%s/shard%d.json", dir, i)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		finish(process([]byte(shard), 1), f)
+		f.Close()
+		paths = append(paths, path)
+	}
+
+	setOptions(t, func(o *options) { o.format = "brace"; o.rawTenths = false })
+	var merged bytes.Buffer
+	mergeResultFiles(paths, &merged)
+
+	want := result(t, strings.Join(shards, ""))
+	if merged.String() != want {
+		t.Errorf("merged %q, want %q", merged.String(), want)
+	}
+}
+
+func TestExternalSort(t *testing.T) {
+	var input bytes.Buffer
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&input, "station-%03d;1.0\n", (i*7)%500)
+	}
+	want := result(t, input.String())
+
+	// Small runs force several spill files; the merged order must be
+	// byte-identical to the in-memory sort.
+	setOptions(t, func(o *options) { o.extSort = 64 })
+	if got := result(t, input.String()); got != want {
+		t.Errorf("external sort diverged from sort.Strings")
+	}
+}
+
+func TestTee(t *testing.T) {
+	setOptions(t, func(o *options) { o.format = "json" })
+
+	res := process([]byte("a;1.0\nb;2.0\nc;3.0\nd;4.0\n"), 1)
+	var machine, human bytes.Buffer
+	printResult(res, &machine)
+	printResultAs(res, &human, "table")
+
+	if !strings.HasPrefix(machine.String(), `{"a":`) {
+		t.Errorf("machine output %q is not json", machine.String())
+	}
+	if !strings.Contains(human.String(), "Station") {
+		t.Errorf("tee output %q is not the table format", human.String())
+	}
+}
+
+func TestParseNumberConsistency(t *testing.T) {
+	// All three parsers must agree over the whole valid domain, so an
+	// edit to either the BCD math or the byte loop cannot diverge
+	// unnoticed.
+	for tenths := -999; tenths <= 999; tenths++ {
+		sign := ""
+		if tenths < 0 {
+			sign = "-"
+		}
+		a := abs(tenths)
+		in := fmt.Sprintf("%s%d.%d", sign, a/10, a%10)
+
+		if v := parseNumber([]byte(in)); v != int64(tenths) {
+			t.Fatalf("parseNumber(%q) = %d, want %d", in, v, tenths)
+		}
+		b := []byte(in + "\nxxxxxxx")
+		if v, n := parseNumberLE(binary.LittleEndian.Uint64(b)); v != int64(tenths) || n != len(in)+1 {
+			t.Fatalf("parseNumberLE(%q) = (%d, %d), want (%d, %d)", in, v, n, tenths, len(in)+1)
+		}
+		f, err := strconv.ParseFloat(in, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := int64(math.Round(f * 10)); v != int64(tenths) {
+			t.Fatalf("strconv path on %q = %d, want %d", in, v, tenths)
+		}
+	}
+}
+
+func TestTruncateNames(t *testing.T) {
+	setOptions(t, func(o *options) { o.truncateNames = 10 })
+
+	// Distinct stations sharing the first 10 bytes merge under the
+	// truncated key.
+	input := "Observatory East;1.0\nObservatory West;3.0\nOslo;2.0\n"
+	want := "{Observator=1.0/2.0/3.0, Oslo=2.0/2.0/2.0}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The cut never splits a multi-byte rune: byte 4 falls inside 'ü'.
+	setOptions(t, func(o *options) { o.truncateNames = 4 })
+	if got := result(t, "Zürich;1.0\n"); got != "{Zür=1.0/1.0/1.0}\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	var a, b bytes.Buffer
+	generateMeasurements("rows=1000,stations=7,seed=42", &a)
+	generateMeasurements("rows=1000,stations=7,seed=42", &b)
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Error("same seed produced different files")
+	}
+	generateMeasurements("rows=1000,stations=7,seed=43", &b)
+	if bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Error("different seeds produced the same file")
+	}
+
+	// The generated grammar must round-trip through the fast parser.
+	res := process(a.Bytes(), 4)
+	if len(res) != 7 {
+		t.Errorf("got %d stations, want 7", len(res))
+	}
+	var total int64
+	for _, m := range res {
+		total += m.count
+		if m.min < -999 || m.max > 999 {
+			t.Errorf("value out of domain: min %d max %d", m.min, m.max)
+		}
+	}
+	if total != 1000 {
+		t.Errorf("got %d rows, want 1000", total)
+	}
+}
+
+func TestAggregatorAPI(t *testing.T) {
+	pairs := []struct {
+		id string
+		v  int64
+	}{
+		{"London", 10}, {"Oslo", -34}, {"London", 25}, {"Paris", 0},
+	}
+	a, b := NewAggregator(), NewAggregator()
+	for i, p := range pairs {
+		if i%2 == 0 {
+			a.Add([]byte(p.id), p.v)
+		} else {
+			b.Add([]byte(p.id), p.v)
+		}
+	}
+	a.Merge(b)
+
+	var got bytes.Buffer
+	printResult(measurements(a.Result()), &got)
+	want := result(t, "London;1.0\nOslo;-3.4\nLondon;2.5\nParis;0.0\n")
+	if got.String() != want {
+		t.Errorf("got %q, want %q", got.String(), want)
+	}
+}
+
+func TestTruncatedFinalRow(t *testing.T) {
+	// A file truncated mid-write must not fabricate a reading from the
+	// fragment: "London;1" cut from "London;12.3" would read as 1.0.
+	want := "{Oslo=2.0/2.0/2.0}\n"
+	for _, fragment := range []string{"London;", "Lon", "London;1"} {
+		if got := result(t, "Oslo;2.0\n"+fragment); got != want {
+			t.Errorf("fragment %q: got %q, want %q", fragment, got, want)
+		}
+	}
+
+	// A complete final row without a newline still counts.
+	if got := result(t, "Oslo;2.0\nLondon;1.2"); got != "{London=1.2/1.2/1.2, Oslo=2.0/2.0/2.0}\n" {
+		t.Errorf("complete final row: got %q", got)
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	path := t.TempDir() + "/baseline.json"
+	if err := os.WriteFile(path, []byte(`{"a": 1.0, "b": -0.5}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	baselineMeans = loadBaseline(path)
+	t.Cleanup(func() { baselineMeans = nil })
+
+	input := "a;2.0\na;3.0\nb;1.0\nc;4.0\n"
+	var out bytes.Buffer
+	finish(process([]byte(input), 1), &out)
+	// a: mean 2.5 - 1.0 = 1.5; b: 1.0 - (-0.5) = 1.5; c has no baseline.
+	want := "{a=2.0/1.5/3.0, b=1.0/1.5/1.0, c=4.0/4.0/4.0}\n"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	setOptions(t, func(o *options) { o.omitUnbaselined = true; o.anomalyMinmax = true })
+	out.Reset()
+	finish(process([]byte(input), 1), &out)
+	want = "{a=1.0/1.5/2.0, b=1.5/1.5/1.5}\n"
+	if got := out.String(); got != want {
+		t.Errorf("anomaly min/max: got %q, want %q", got, want)
+	}
+}
+
+func TestWithCount(t *testing.T) {
+	setOptions(t, func(o *options) { o.withCount = true })
+
+	input := "a;1.0\na;2.0\nb;3.0\n"
+	want := "{a=1.0/1.5/2.0/2, b=3.0/3.0/3.0/1}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	setOptions(t, func(o *options) { o.compact = true })
+	want = "{a=1.0/1.5/2.0/2,b=3.0/3.0/3.0/1}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("with -compact: got %q, want %q", got, want)
+	}
+}
+
+func TestLongIdAtChunkSeam(t *testing.T) {
+	// A multi-kilobyte id that dominates its chunk must aggregate like
+	// any other: chunks end on newlines, so however the seams fall the
+	// id stays within one chunk and only the short temperature tail can
+	// cross into the overlap. -debug asserts that invariant.
+	setOptions(t, func(o *options) { o.debug = true })
+
+	long := strings.Repeat("x", 4096)
+	var input bytes.Buffer
+	for i := 0; i < 16; i++ {
+		fmt.Fprintf(&input, "s%d;1.0\n", i%3)
+		fmt.Fprintf(&input, "%s;%d.5\n", long, i%4)
+	}
+	for _, workers := range []int{1, 2, 7, 16} {
+		res := process(input.Bytes(), workers)
+		m := res[long]
+		if m == nil {
+			t.Fatalf("workers=%d: long id missing", workers)
+		}
+		if m.count != 16 || m.min != 5 || m.max != 35 {
+			t.Errorf("workers=%d: got count=%d min=%d max=%d, want 16/5/35", workers, m.count, m.min, m.max)
+		}
+	}
+}
+
+func TestReportSimilar(t *testing.T) {
+	res := process([]byte("London;1.0\nLONDON;2.0\nLondon.;3.0\nOslo;4.0\n"), 1)
+
+	groups := similarGroups(res)
+	if len(groups) != 1 {
+		t.Fatalf("got %d groups, want 1: %v", len(groups), groups)
+	}
+	if got := len(groups["london"]); got != 3 {
+		t.Errorf("got %d london forms, want 3", got)
+	}
+
+	var report bytes.Buffer
+	reportSimilar(res, &report)
+	want := "similar station ids: [\"LONDON\" \"London\" \"London.\"]\n"
+	if report.String() != want {
+		t.Errorf("got %q, want %q", report.String(), want)
+	}
+}
+
+func TestStartAfter(t *testing.T) {
+	setOptions(t, func(o *options) { o.startAfter = "=== DATA ===" })
+
+	input := "generated by sensor hub\nformat: station;temp\n=== DATA ===\na;1.0\nb;2.0\n"
+	want := "{a=1.0/1.0/1.0, b=2.0/2.0/2.0}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// A marker embedded mid-line does not end the preamble.
+	input = "note: === DATA === appears below\n=== DATA ===\na;1.0\n"
+	if got := result(t, input); got != "{a=1.0/1.0/1.0}\n" {
+		t.Errorf("embedded marker: got %q", got)
+	}
+
+	// Streams skip the preamble the same way.
+	var out bytes.Buffer
+	processStream(strings.NewReader("preamble\n=== DATA ===\na;1.0\n"), &out)
+	if got := out.String(); got != "{a=1.0/1.0/1.0}\n" {
+		t.Errorf("stream: got %q", got)
+	}
+}
+
+func BenchmarkPrefetch(b *testing.B) {
+	// A warm cache cannot show the cold-cache win (drop caches and run
+	// the binary with -prefetch on a large file for that); this at least
+	// exercises the prefetcher alongside the workers.
+	data := bytes.Repeat([]byte("London;12.3\nZürich;-4.7\n"), 1<<16)
+	for _, prefetch := range []bool{false, true} {
+		b.Run(fmt.Sprintf("prefetch=%v", prefetch), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				var stop func()
+				if prefetch {
+					stop = prefetchPages(data)
+				}
+				process(data, 4)
+				if stop != nil {
+					stop()
+				}
+			}
+		})
+	}
+}
+
+func TestMaxStations(t *testing.T) {
+	// The cap is per insertion site, so two stations trip a cap of one
+	// regardless of which chunk table sees them first.
+	setOptions(t, func(o *options) { o.maxStations = 1 })
+
+	if os.Getenv("TEST_MAX_STATIONS") == "1" {
+		process([]byte("a;1.0\nb;2.0\nc;3.0\nd;4.0\n"), 1)
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=TestMaxStations")
+	cmd.Env = append(os.Environ(), "TEST_MAX_STATIONS=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("expected the subprocess to fail, output: %s", out)
+	}
+	if !strings.Contains(string(out), `exceeds the -max-stations cap of`) {
+		t.Errorf("missing cap error in output: %s", out)
+	}
+}
+
+func TestNegativeZero(t *testing.T) {
+	// "-0.0" must parse to exactly 0: the branchless sign handling
+	// computes (0 ^ -1) - (-1), and int64 has no negative zero to leak
+	// into min/max. Verify the bit math directly, then that "-0.0" and
+	// "0.0" rows aggregate identically and never print as "-0.0".
+	b := []byte("-0.0\n___")
+	if v, n := parseNumberLE(binary.LittleEndian.Uint64(b)); v != 0 || n != 5 {
+		t.Errorf("parseNumberLE(%q) = (%d, %d), want (0, 5)", b[:4], v, n)
+	}
+	if v := parseNumber([]byte("-0.0")); v != 0 {
+		t.Errorf("parseNumber(-0.0) = %d, want 0", v)
+	}
+
+	input := "a;-0.0\nb;1.0\nc;1.0\nd;1.0\na;0.0\na;-0.0\n"
+	want := "{a=0.0/0.0/0.0, b=1.0/1.0/1.0, c=1.0/1.0/1.0, d=1.0/1.0/1.0}\n"
+	for _, f := range []func(*options){
+		func(o *options) {},
+		func(o *options) { o.swarIds = true },
+		func(o *options) { o.strict = true },
+		func(o *options) { o.sortedInput = true },
+	} {
+		setOptions(t, f)
+		if got := result(t, input); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestColumns(t *testing.T) {
+	outputColumns = parseColumns("station,max,min,count")
+	t.Cleanup(func() { outputColumns = nil })
+
+	input := "a;1.0\na;2.0\nb;-3.5\n"
+
+	setOptions(t, func(o *options) { o.format = "csv" })
+	want := "station,max,min,count\na,2.0,1.0,2\nb,-3.5,-3.5,1\n"
+	if got := result(t, input); got != want {
+		t.Errorf("csv: got %q, want %q", got, want)
+	}
+
+	setOptions(t, func(o *options) { o.format = "ndjson" })
+	want = `{"station":"a","max":2.0,"min":1.0,"count":2}` + "\n" +
+		`{"station":"b","max":-3.5,"min":-3.5,"count":1}` + "\n"
+	if got := result(t, input); got != want {
+		t.Errorf("ndjson: got %q, want %q", got, want)
+	}
+
+	setOptions(t, func(o *options) { o.format = "table" })
+	got := result(t, input)
+	if !strings.Contains(got, "Station") || !strings.Contains(got, "Count") {
+		t.Errorf("table: missing headers in %q", got)
+	}
+	if strings.Contains(got, "Mean") {
+		t.Errorf("table: unselected Mean column present in %q", got)
+	}
+}
+
+func TestDistinctValues(t *testing.T) {
+	setOptions(t, func(o *options) { o.distinctValues = true })
+
+	// a sees 3 distinct values across 5 readings, b one value twice.
+	input := "a;1.0\na;2.0\na;1.0\na;2.5\na;2.5\nb;-3.0\nb;-3.0\n"
+	want := "{a=1.0/1.8/2.5/3, b=-3.0/-3.0/-3.0/1}\n"
+	for _, workers := range []int{1, 4} {
+		res := process([]byte(input), workers)
+		var out bytes.Buffer
+		printResult(res, &out)
+		if got := out.String(); got != want {
+			t.Errorf("workers=%d: got %q, want %q", workers, got, want)
+		}
+	}
+}
+
+func TestReverseMergeInvariant(t *testing.T) {
+	// Merging chunk partials must be commutative for min/max/sum/count:
+	// fold two chunk results in both orders and compare.
+	data := []byte("a;1.0\nb;2.0\na;-3.0\nc;4.4\nb;0.1\na;9.9\n")
+	half := bytes.Index(data, []byte("c;"))
+	p1 := processChunk(data, 0, half)
+	p2 := processChunk(data, half, len(data))
+
+	fwd := measurements{}
+	fwd.merge(copyMeasurements(p1))
+	fwd.merge(copyMeasurements(p2))
+	rev := measurements{}
+	rev.merge(copyMeasurements(p2))
+	rev.merge(copyMeasurements(p1))
+	if len(fwd) != len(rev) {
+		t.Fatalf("station counts differ: %d vs %d", len(fwd), len(rev))
+	}
+	for id, m := range fwd {
+		o := rev[id]
+		if o.min != m.min || o.max != m.max || o.sum != m.sum || o.count != m.count {
+			t.Errorf("station %q: %+v vs %+v", id, m, o)
+		}
+	}
+
+	// The -debug runtime check runs the same comparison inside process.
+	setOptions(t, func(o *options) { o.debug = true })
+	want := "{a=-3.0/2.6/9.9, b=0.1/1.1/2.0, c=4.4/4.4/4.4}\n"
+	if got := result(t, string(data)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	dir := t.TempDir()
+	// Write the rotated files oldest-first with explicit mtimes so the
+	// chronological order differs from the lexical one.
+	files := map[string]string{
+		"measurements.2": "a;1.0\nb;5.0\n",
+		"measurements.1": "a;3.0\n",
+		"measurements":   "b;-2.0\na;2.0\n",
+	}
+	base := time.Now().Add(-time.Hour)
+	for i, name := range []string{"measurements.2", "measurements.1", "measurements"} {
+		path := dir + "/" + name
+		if err := os.WriteFile(path, []byte(files[name]), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := base.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setOptions(t, func(o *options) { o.glob = dir + "/measurements*" })
+	var out bytes.Buffer
+	processGlob(opt.glob, &out)
+	want := "{a=1.0/2.0/3.0, b=-2.0/1.5/5.0}\n"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestAssumeASCII(t *testing.T) {
+	// Default byte-wise folding leaves non-ASCII letters alone, so the
+	// two spellings of Zürich stay distinct stations.
+	setOptions(t, func(o *options) { o.caseFold = true })
+	input := "ZÜRICH;1.0\nzürich;3.0\n"
+	if got := result(t, input); got != "{zÜrich=1.0/1.0/1.0, zürich=3.0/3.0/3.0}\n" {
+		t.Errorf("ascii fold: got %q", got)
+	}
+
+	// The Unicode path folds them together.
+	setOptions(t, func(o *options) { o.caseFold = true; o.assumeASCII = false })
+	if got := result(t, input); got != "{zürich=1.0/2.0/3.0}\n" {
+		t.Errorf("unicode fold: got %q", got)
+	}
+
+	// Truncation counts bytes by default and runes under the Unicode
+	// path: 3 bytes of "Zürich" is "Zü", 3 runes is "Zür".
+	setOptions(t, func(o *options) { o.caseFold = false; o.assumeASCII = true; o.truncateNames = 3 })
+	if got := result(t, "Zürich;1.0\n"); got != "{Zü=1.0/1.0/1.0}\n" {
+		t.Errorf("byte truncation: got %q", got)
+	}
+	setOptions(t, func(o *options) { o.caseFold = false; o.truncateNames = 3; o.assumeASCII = false })
+	if got := result(t, "Zürich;1.0\n"); got != "{Zür=1.0/1.0/1.0}\n" {
+		t.Errorf("rune truncation: got %q", got)
+	}
+}
+
+func TestRunReport(t *testing.T) {
+	path := t.TempDir() + "/report.json"
+	setOptions(t, func(o *options) { o.runReport = path })
+
+	input := "a;1.0\nb;2.0\nc;3.0\nd;4.0\ne;5.0\nf;6.0\n"
+	process([]byte(input), 2)
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		InputBytes       int `json:"inputBytes"`
+		Workers          int `json:"workers"`
+		TotalRows        int `json:"totalRows"`
+		DistinctStations int `json:"distinctStations"`
+		Chunks           []struct {
+			Start, End, Bytes, Rows int
+		} `json:"chunks"`
+	}
+	if err := json.Unmarshal(buf, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.InputBytes != len(input) || report.Workers != 2 {
+		t.Errorf("input %d workers %d, want %d and 2", report.InputBytes, report.Workers, len(input))
+	}
+	if report.TotalRows != 6 || report.DistinctStations != 6 {
+		t.Errorf("rows %d stations %d, want 6 and 6", report.TotalRows, report.DistinctStations)
+	}
+	var chunkRows int
+	for _, c := range report.Chunks {
+		if c.Bytes != c.End-c.Start {
+			t.Errorf("chunk bytes %d != end-start %d", c.Bytes, c.End-c.Start)
+		}
+		chunkRows += c.Rows
+	}
+	// The final row parses outside the chunks.
+	if chunkRows != 5 {
+		t.Errorf("chunk rows %d, want 5", chunkRows)
+	}
+}
+
+func TestUnicodeMinus(t *testing.T) {
+	setOptions(t, func(o *options) { o.unicodeMinus = true })
+
+	// Both minus forms mixed in one file: ASCII '-' and U+2212.
+	input := "a;−1.5\nb;2.0\na;-0.5\nb;−3.0\n"
+	want := "{a=-1.5/-1.0/-0.5, b=-3.0/-0.5/2.0}\n"
+	if got := result(t, input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// syncBuffer serializes concurrent writes from the flush ticker.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestFlushInterval(t *testing.T) {
+	var out syncBuffer
+	a := newAggregator()
+	a.emitTo = &out
+	a.startFlusher(5 * time.Millisecond)
+
+	io.WriteString(a, "a;1.0\n")
+	deadline := time.Now().Add(2 * time.Second)
+	for out.String() == "" && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := out.String(); got != "{a=1.0/1.0/1.0}\n" {
+		t.Fatalf("ticker flush: got %q", got)
+	}
+
+	// The final emit fires on Close even if the ticker never sees the
+	// last rows.
+	io.WriteString(a, "b;2.0")
+	a.Close()
+	got := out.String()
+	if !strings.HasSuffix(got, "{a=1.0/1.0/1.0, b=2.0/2.0/2.0}\n") {
+		t.Errorf("final flush: got %q", got)
+	}
+}
+
+func TestGzipMultistream(t *testing.T) {
+	// Rotated logs are often concatenated gzip members; the reader must
+	// decompress all of them, not stop at the first member boundary.
+	var buf bytes.Buffer
+	for _, member := range []string{"a;1.0\nb;2.0\n", "a;3.0\nc;-4.0\n"} {
+		zw := gzip.NewWriter(&buf)
+		io.WriteString(zw, member)
+		zw.Close()
+	}
+
+	var out bytes.Buffer
+	processStream(maybeGzip(&buf), &out)
+	want := "{a=1.0/2.0/3.0, b=2.0/2.0/2.0, c=-4.0/-4.0/-4.0}\n"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestQuantize(t *testing.T) {
+	setOptions(t, func(o *options) { o.quantize = 5 })
+	for _, tc := range []struct{ in, want int64 }{
+		{12, 10}, {13, 15}, {-12, -10}, {-13, -15}, {0, 0}, {999, 1000},
+	} {
+		if got := adjustTenths(tc.in); got != tc.want {
+			t.Errorf("adjustTenths(%d) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+
+	// Ties round away from zero.
+	setOptions(t, func(o *options) { o.quantize = 2 })
+	if got := adjustTenths(1); got != 2 {
+		t.Errorf("adjustTenths(1) = %d, want 2", got)
+	}
+	if got := adjustTenths(-1); got != -2 {
+		t.Errorf("adjustTenths(-1) = %d, want -2", got)
+	}
+
+	// min/max/sum reflect snapped values, count does not change.
+	setOptions(t, func(o *options) { o.quantize = 5; o.withCount = true })
+	input := "a;1.2\na;1.3\na;-1.2\na;-1.3\n"
+	if got := result(t, input); got != "{a=-1.5/0.0/1.5/4}\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	setOptions(t, func(o *options) {})
+	env := map[string]string{}
+	getenv := func(k string) string { return env[k] }
+	flagSet := func(name string) bool { return false }
+
+	// Unset variables leave the defaults in place.
+	defaultWorkers := opt.workers
+	applyEnvOverrides(flagSet, getenv)
+	if opt.workers != defaultWorkers || opt.noMmap {
+		t.Errorf("defaults changed: workers=%d noMmap=%v", opt.workers, opt.noMmap)
+	}
+
+	// The environment overrides the default.
+	env["ONEBRC_WORKERS"] = "3"
+	env["ONEBRC_NO_MMAP"] = "true"
+	applyEnvOverrides(flagSet, getenv)
+	if opt.workers != 3 || !opt.noMmap {
+		t.Errorf("env override: workers=%d noMmap=%v, want 3 and true", opt.workers, opt.noMmap)
+	}
+
+	// An explicit flag beats the environment.
+	setOptions(t, func(o *options) { o.workers = 7; o.noMmap = false })
+	applyEnvOverrides(func(name string) bool { return true }, getenv)
+	if opt.workers != 7 || opt.noMmap {
+		t.Errorf("flag precedence: workers=%d noMmap=%v, want 7 and false", opt.workers, opt.noMmap)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	var out bytes.Buffer
+	explainRows([]byte("London;12.3\nZürich;-4.7\nOslo;0.0\nbad row\n"), 5, &out)
+	want := `row 1: id="London" temp="12.3" tenths=123 consumed=5
+row 2: id="Zürich" temp="-4.7" tenths=-47 consumed=5
+row 3: id="Oslo" temp="0.0" tenths=0 consumed=4
+row 4: "bad row": no ';' separator
+`
+	if got := out.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestOutputEncodingLatin1(t *testing.T) {
+	setOptions(t, func(o *options) { o.outputEncoding = "latin1" })
+
+	// Zürich maps to Latin-1, the CJK name does not and is replaced.
+	input := "Zürich;1.0\n東京;2.0\n"
+	got := result(t, input)
+	want := "{Z\xfcrich=1.0/1.0/1.0, ??=2.0/2.0/2.0}\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMmapThreshold(t *testing.T) {
+	path := t.TempDir() + "/measurements.txt"
+	if err := os.WriteFile(path, []byte("a;1.0\nb;2.0\na;3.0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The read and mmap paths must produce identical output.
+	run := func(threshold int) string {
+		setOptions(t, func(o *options) { o.mmapThreshold = threshold })
+		var out bytes.Buffer
+		processFile(path, &out)
+		return out.String()
+	}
+	want := "{a=1.0/2.0/3.0, b=2.0/2.0/2.0}\n"
+	if got := run(1 << 20); got != want {
+		t.Errorf("read path: got %q, want %q", got, want)
+	}
+	if got := run(0); got != want {
+		t.Errorf("mmap path: got %q, want %q", got, want)
+	}
+}
+
+func TestResultStringAndJSON(t *testing.T) {
+	res, err := ProcessContext(context.Background(), []byte("b;2.0\na;1.0\na;3.0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.String(); got != "{a=1.0/2.0/3.0, b=2.0/2.0/2.0}" {
+		t.Errorf("String() = %q", got)
+	}
+	buf, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":{"min":1.0,"mean":2.0,"max":3.0,"count":2},"b":{"min":2.0,"mean":2.0,"max":2.0,"count":1}}`
+	if string(buf) != want {
+		t.Errorf("MarshalJSON = %s, want %s", buf, want)
+	}
+	var decoded map[string]struct{ Min, Mean, Max float64 }
+	if err := json.Unmarshal(buf, &decoded); err != nil {
+		t.Errorf("output is not valid json: %v", err)
+	}
+}
+
+func TestUseHeader(t *testing.T) {
+	// One numeric column, default order.
+	setOptions(t, func(o *options) { o.useHeader = true })
+	input := "#station;temperature\na;1.0\nb;2.0\n"
+	if got := result(t, input); got != "{a=1.0/1.0/1.0, b=2.0/2.0/2.0}\n" {
+		t.Errorf("single column: got %q", got)
+	}
+
+	// Two numeric columns: only the temperature aggregates.
+	setOptions(t, func(o *options) { o.useHeader = true })
+	input = "#station;temp;humidity\na;1.0;55\nb;2.0;60\na;3.0;58\n"
+	if got := result(t, input); got != "{a=1.0/2.0/3.0, b=2.0/2.0/2.0}\n" {
+		t.Errorf("extra column: got %q", got)
+	}
+
+	// The header can also declare the temp-first layout.
+	setOptions(t, func(o *options) { o.useHeader = true })
+	input = "#temperature;station\n1.0;a\n2.0;b\n"
+	if got := result(t, input); got != "{a=1.0/1.0/1.0, b=2.0/2.0/2.0}\n" {
+		t.Errorf("temp-first: got %q", got)
+	}
+}
+
+func TestFormatDense(t *testing.T) {
+	orderFile := t.TempDir() + "/stations.txt"
+	if err := os.WriteFile(orderFile, []byte("b\nmissing\na\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	setOptions(t, func(o *options) { o.format = "dense"; o.orderFile = orderFile })
+
+	input := "a;1.0\nb;2.0\na;3.0\n"
+	if got := result(t, input); got != "2.0,NaN,2.0\n" {
+		t.Errorf("got %q", got)
+	}
+
+	setOptions(t, func(o *options) { o.fill = "-999" })
+	if got := result(t, input); got != "2.0,-999,2.0\n" {
+		t.Errorf("custom fill: got %q", got)
+	}
+}
+
+func TestConcurrentProcess(t *testing.T) {
+	// Each goroutine aggregates its own dataset; any shared mutable
+	// state between process calls would let results bleed across them.
+	const goroutines = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			var input bytes.Buffer
+			for row := 0; row < 100; row++ {
+				fmt.Fprintf(&input, "S%02d;%d.%d\n", g, row%10, g%10)
+			}
+			meanTenths := 45 + g%10
+			want := fmt.Sprintf("{S%02d=0.%d/%d.%d/9.%d}\n", g, g%10, meanTenths/10, meanTenths%10, g%10)
+			for run := 0; run < 10; run++ {
+				var out bytes.Buffer
+				printResult(process(input.Bytes(), 4), &out)
+				if got := out.String(); got != want {
+					errs <- fmt.Errorf("goroutine %d run %d: got %q, want %q", g, run, got, want)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestReservoirSample(t *testing.T) {
+	// A station with ten distinct readings and a one-slot reservoir:
+	// over many runs with different seeds each reading should be kept
+	// roughly equally often, or the sampling is biased.
+	var input bytes.Buffer
+	for v := 0; v < 10; v++ {
+		fmt.Fprintf(&input, "a;%d.0\n", v)
+	}
+
+	const runs = 1000
+	counts := make([]int, 10)
+	for seed := int64(0); seed < runs; seed++ {
+		setOptions(t, func(o *options) { o.reservoir = 1; o.reservoirSeed = seed })
+		res := process(input.Bytes(), 2)
+		sample := res["a"].sample
+		if sample == nil || len(sample.vals) != 1 || sample.n != 10 {
+			t.Fatalf("seed %d: unexpected reservoir %+v", seed, sample)
+		}
+		counts[sample.vals[0]/10]++
+	}
+	for v, n := range counts {
+		// Expected 100 per value; the allowance is over 5 sigma.
+		if n < 50 || n > 160 {
+			t.Errorf("value %d.0 sampled %d times out of %d, want ~%d", v, n, runs, runs/10)
+		}
+	}
+
+	// The dump lists each station's sampled readings.
+	out := t.TempDir() + "/reservoir.txt"
+	setOptions(t, func(o *options) { o.reservoir = 4; o.reservoirOut = out })
+	finish(process([]byte("a;1.0\nb;2.0\nc;3.0\nd;4.0\nb;2.5\n"), 1), io.Discard)
+	buf, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf)
+	if !strings.Contains(got, "b;2.0;2.5\n") || !strings.Contains(got, "a;1.0\n") {
+		t.Errorf("dump:\n%s", got)
+	}
+}
+
+func TestCrossValidateSimple(t *testing.T) {
+	// Build and run the simple strconv-based implementation in go/ on a
+	// generated dataset and require byte-identical output from the fast
+	// parser. Both sides already clamp -0.0 to 0.0 (nonNegZero there,
+	// the sign fixup in meanString here), so any diff is a real parsing
+	// or rounding divergence.
+	dir := t.TempDir()
+	input := dir + "/measurements.txt"
+	f, err := os.Create(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generateMeasurements("rows=20000,stations=100,seed=7", f)
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bin := dir + "/onebrc-simple"
+	build := exec.Command("go", "build", "-o", bin, ".")
+	build.Dir = "../../../../go"
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building the simple implementation: %v\n%s", err, out)
+	}
+	want, err := exec.Command(bin, input).Output()
+	if err != nil {
+		t.Fatalf("running the simple implementation: %v", err)
+	}
+
+	setOptions(t, func(o *options) {})
+	var got bytes.Buffer
+	processFile(input, &got)
+	if got.String() != string(want) {
+		t.Errorf("fast and simple outputs diverge:\nfast:   %s\nsimple: %s", &got, want)
+	}
+}
+
+func TestFormatProtobuf(t *testing.T) {
+	// Decode the length-delimited StationStat stream by hand, the same
+	// wire rules printProtobuf encodes with.
+	type stat struct {
+		station                 string
+		min, mean, max          float64
+		count, minT, maxT, sumT int64
+	}
+	decode := func(raw []byte) []stat {
+		var stats []stat
+		for len(raw) > 0 {
+			size, n := binary.Uvarint(raw)
+			if n <= 0 || uint64(len(raw[n:])) < size {
+				t.Fatalf("bad length prefix in % x", raw)
+			}
+			msg := raw[n : n+int(size)]
+			raw = raw[n+int(size):]
+			var st stat
+			for len(msg) > 0 {
+				tag, n := binary.Uvarint(msg)
+				msg = msg[n:]
+				field, wire := tag>>3, tag&7
+				switch wire {
+				case 0:
+					v, n := binary.Uvarint(msg)
+					msg = msg[n:]
+					zigzag := int64(v>>1) ^ -int64(v&1)
+					switch field {
+					case 5:
+						st.count = int64(v)
+					case 6:
+						st.minT = zigzag
+					case 7:
+						st.maxT = zigzag
+					case 8:
+						st.sumT = zigzag
+					}
+				case 1:
+					v := math.Float64frombits(binary.LittleEndian.Uint64(msg))
+					msg = msg[8:]
+					switch field {
+					case 2:
+						st.min = v
+					case 3:
+						st.mean = v
+					case 4:
+						st.max = v
+					}
+				case 2:
+					size, n := binary.Uvarint(msg)
+					msg = msg[n:]
+					if field == 1 {
+						st.station = string(msg[:size])
+					}
+					msg = msg[size:]
+				default:
+					t.Fatalf("unexpected wire type %d", wire)
+				}
+			}
+			stats = append(stats, st)
+		}
+		return stats
+	}
+
+	setOptions(t, func(o *options) { o.format = "protobuf" })
+	input := "b;2.0\na;1.0\na;2.0\n"
+	got := decode([]byte(result(t, input)))
+	want := []stat{
+		{station: "a", min: 1, mean: 1.5, max: 2, count: 2},
+		{station: "b", min: 2, mean: 2, max: 2, count: 1},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("message %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	setOptions(t, func(o *options) { o.rawTenths = true })
+	got = decode([]byte(result(t, input)))
+	want = []stat{
+		{station: "a", count: 2, minT: 10, maxT: 20, sumT: 30},
+		{station: "b", count: 1, minT: 20, maxT: 20, sumT: 20},
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("raw tenths message %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	// The file fits inside the 1MB sample, so the extrapolated row and
+	// station counts must match the file exactly.
+	input := t.TempDir() + "/measurements.txt"
+	f, err := os.Create(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generateMeasurements("rows=5000,stations=42,seed=3", f)
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	setOptions(t, func(o *options) { o.estimate = true })
+	var out bytes.Buffer
+	processFile(input, &out)
+	got := out.String()
+	for _, want := range []string{
+		"estimated rows: 5000 ",
+		"estimated distinct stations: 42\n",
+		"projected runtime: ",
+		"projected peak memory: ",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestOffsetOutOfDomain(t *testing.T) {
+	// -offset-tenths can push adjusted readings past the ±99.9 tenths
+	// domain the -dedupe/-distinct-values bitset covers; that must be a
+	// clear failure, not an out-of-range panic.
+	setOptions(t, func(o *options) { o.dedupe = true; o.offsetTenths = 500 })
+
+	if os.Getenv("TEST_OFFSET_DOMAIN") == "1" {
+		process([]byte("a;60.0\nb;1.0\nc;1.0\nd;60.0\n"), 1)
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=TestOffsetOutOfDomain")
+	cmd.Env = append(os.Environ(), "TEST_OFFSET_DOMAIN=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("expected the subprocess to fail, output: %s", out)
+	}
+	if !strings.Contains(string(out), "outside the domain") {
+		t.Errorf("missing domain error in output: %s", out)
+	}
+
+	// In-domain offsets still dedupe.
+	setOptions(t, func(o *options) { o.dedupe = true; o.offsetTenths = 10 })
+	if got := result(t, "a;1.0\na;1.0\na;3.0\n"); got != "{a=2.0/3.0/4.0}\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestSWARIdsStripSuffix(t *testing.T) {
+	// The SWAR path must skip unit bytes like the byte-wise path does;
+	// landing on them instead corrupts the next id scan, swallowing the
+	// newline into the key.
+	setOptions(t, func(o *options) { o.swarIds = true; o.stripSuffix = true })
+
+	input := "alpha;1.0C\nbeta;2.0°C\nalpha;3.0C\ngamma;-1.5C\n"
+	want := "{alpha=1.0/2.0/3.0, beta=2.0/2.0/2.0, gamma=-1.5/-1.5/-1.5}\n"
+	for _, workers := range []int{1, 4} {
+		var buf bytes.Buffer
+		printResult(process([]byte(input), workers), &buf)
+		if got := buf.String(); got != want {
+			t.Errorf("workers=%d: got %q, want %q", workers, got, want)
+		}
+	}
+}
+
+func TestStripSuffixNearEOF(t *testing.T) {
+	// A suffixed row within 8 bytes of EOF takes the byte-at-a-time
+	// fallback, which must strip the unit like the word-wise path does
+	// instead of parsing 'C' as a digit.
+	setOptions(t, func(o *options) { o.stripSuffix = true })
+	if got := result(t, "x;1.0C\n\n"); got != "{x=1.0/1.0/1.0}\n" {
+		t.Errorf("got %q", got)
+	}
+
+	setOptions(t, func(o *options) { o.stripSuffix = true; o.sortedInput = true })
+	if got := result(t, "x;1.0C\n\n"); got != "{x=1.0/1.0/1.0}\n" {
+		t.Errorf("sorted input: got %q", got)
+	}
+}
+
+func TestOrderTempFirstStripSuffix(t *testing.T) {
+	// The temp-first scan must skip unit bytes before the ';' or the
+	// suffix leaks into the station key.
+	setOptions(t, func(o *options) { o.order = "temp-first"; o.stripSuffix = true })
+
+	input := "1.0C;alpha\n2.0°C;beta\n3.0C;alpha\n-1.5;gamma\n"
+	want := "{alpha=1.0/2.0/3.0, beta=2.0/2.0/2.0, gamma=-1.5/-1.5/-1.5}\n"
+	for _, workers := range []int{1, 4} {
+		var buf bytes.Buffer
+		printResult(process([]byte(input), workers), &buf)
+		if got := buf.String(); got != want {
+			t.Errorf("workers=%d: got %q, want %q", workers, got, want)
+		}
+	}
+}
+
+func TestFormatParquet(t *testing.T) {
+	setOptions(t, func(o *options) { o.format = "parquet" })
+	raw := []byte(result(t, "b;2.0\na;1.0\na;2.0\n"))
+
+	if !bytes.HasPrefix(raw, []byte("PAR1")) || !bytes.HasSuffix(raw, []byte("PAR1")) {
+		t.Fatalf("missing magic framing in % x", raw[:8])
+	}
+	// The trailer is the footer length followed by the closing magic.
+	footerLen := int(binary.LittleEndian.Uint32(raw[len(raw)-8 : len(raw)-4]))
+	footer := raw[len(raw)-8-footerLen : len(raw)-8]
+	if footer[0] != 0x15 || !bytes.Contains(footer, []byte("station")) ||
+		!bytes.Contains(footer, []byte("count")) || !bytes.Contains(footer, []byte("onebrc")) {
+		t.Errorf("unexpected footer: % x", footer)
+	}
+
+	// The station column is the first page after the magic: its header,
+	// then the ids PLAIN-encoded in output order.
+	page := append(parquetPageHeader(2, 10), 1, 0, 0, 0, 'a', 1, 0, 0, 0, 'b')
+	if !bytes.HasPrefix(raw[4:], page) {
+		t.Errorf("station page mismatch:\ngot  % x\nwant % x", raw[4:4+len(page)], page)
+	}
+	// The mean column carries the rounded doubles: a averages to 1.5.
+	mean := binary.LittleEndian.AppendUint64(nil, math.Float64bits(1.5))
+	mean = binary.LittleEndian.AppendUint64(mean, math.Float64bits(2.0))
+	if !bytes.Contains(raw, mean) {
+		t.Errorf("mean values not found in % x", raw)
+	}
+
+	// -raw-tenths swaps the doubles for exact integer tenths.
+	setOptions(t, func(o *options) { o.rawTenths = true })
+	raw = []byte(result(t, "b;2.0\na;1.0\na;2.0\n"))
+	sums := binary.LittleEndian.AppendUint64(nil, 30) // a: 1.0+2.0
+	sums = binary.LittleEndian.AppendUint64(sums, 20)
+	if !bytes.Contains(raw, sums) {
+		t.Errorf("raw tenths sums not found in % x", raw)
+	}
+}
@@ -0,0 +1,31 @@
+//go:build mips || mips64 || ppc64 || s390x
+
+/*
+ *  Copyright 2023 The original authors
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package main
+
+import "encoding/binary"
+
+// loadNumberWord loads the next 8 input bytes with the platform's native
+// order; parseNumberWord decodes the result.
+func loadNumberWord(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
+
+func parseNumberWord(word uint64) (int64, int) {
+	return parseNumberBE(word)
+}
@@ -0,0 +1,3 @@
+module onebrc
+
+go 1.21
@@ -0,0 +1,42 @@
+//go:build windows
+
+/*
+ *  Copyright 2023 The original authors
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// normalizePath works around the classic MAX_PATH limit: opening an
+// absolute path longer than 247 bytes requires the `\\?\` verbatim
+// prefix (`\\?\UNC\` for network shares), so deeply nested measurement
+// files open correctly.
+func normalizePath(path string) string {
+	if len(path) < 248 || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC` + abs[1:]
+	}
+	return `\\?\` + abs
+}
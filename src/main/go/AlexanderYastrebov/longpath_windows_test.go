@@ -0,0 +1,50 @@
+//go:build windows
+
+/*
+ *  Copyright 2023 The original authors
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeLongPath(t *testing.T) {
+	dir := t.TempDir()
+	for len(dir) < 260 {
+		dir = filepath.Join(dir, strings.Repeat("d", 50))
+	}
+	if err := os.MkdirAll(normalizePath(dir), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "measurements.txt")
+	if err := os.WriteFile(normalizePath(path), []byte("London;12.3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(normalizePath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if got := normalizePath(path); !strings.HasPrefix(got, `\\?\`) {
+		t.Errorf("normalizePath(%q) = %q, want a \\\\?\\ prefix", path, got)
+	}
+}
@@ -0,0 +1,56 @@
+//go:build unix
+
+/*
+ *  Copyright 2023 The original authors
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// mmapPadded maps the file with at least chunkOverlap bytes of readable
+// slack past the end. For sizes that are not a page multiple the kernel
+// zero-fills the final partial page; exactly at a page multiple there is
+// no such padding and an 8-byte load at EOF would fault, so the file is
+// instead mapped with MAP_FIXED over the front of a one-page larger
+// anonymous reservation. The returned slice covers the whole reservation
+// for munmap; callers use the first size bytes.
+func mmapPadded(fd int, size int) ([]byte, error) {
+	pagesize := syscall.Getpagesize()
+	if size%pagesize != 0 {
+		return syscall.Mmap(fd, 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	}
+	region, err := syscall.Mmap(-1, 0, size+pagesize, syscall.PROT_READ, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_MMAP,
+		uintptr(unsafe.Pointer(&region[0])), uintptr(size),
+		uintptr(syscall.PROT_READ), uintptr(syscall.MAP_SHARED|syscall.MAP_FIXED),
+		uintptr(fd), 0)
+	if errno != 0 {
+		syscall.Munmap(region)
+		return nil, errno
+	}
+	return region, nil
+}
+
+// munmap releases a mmapPadded region.
+func munmap(region []byte) error {
+	return syscall.Munmap(region)
+}
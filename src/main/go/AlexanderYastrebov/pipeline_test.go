@@ -0,0 +1,43 @@
+//go:build pipeline
+
+/*
+ *  Copyright 2023 The original authors
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestPipelinedMatchesFused(t *testing.T) {
+	var input bytes.Buffer
+	for i := 0; i < 10*pipelineBatch; i++ {
+		fmt.Fprintf(&input, "station-%03d;%d.%d\n", i%700, i%100, i%10)
+	}
+	data := input.Bytes()
+
+	fused := processChunk(data, 0, len(data))
+	pipelined := processChunkPipelined(data, 0, len(data))
+
+	var a, b bytes.Buffer
+	printResult(fused, &a)
+	printResult(pipelined, &b)
+	if a.String() != b.String() {
+		t.Errorf("pipelined result differs:\nfused     %q\npipelined %q", a.String(), b.String())
+	}
+}